@@ -1,32 +1,167 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
+	"log"
 	"net/http"
-	"text/template"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/andrerussowsky/chat-app/internal/auth"
+	"github.com/andrerussowsky/chat-app/internal/bot"
+	"github.com/andrerussowsky/chat-app/internal/broker"
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/config"
 	"github.com/andrerussowsky/chat-app/internal/handlers"
+	"github.com/andrerussowsky/chat-app/internal/health"
+	"github.com/andrerussowsky/chat-app/internal/rabbitmq"
+	"github.com/andrerussowsky/chat-app/internal/storage"
 )
 
 var templates *template.Template
 
 func main() {
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:]) // Load configuration
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if cfg.UsesDevSecrets() {
+		log.Println("Warning: using the development JWT secret, set CHAT_JWT_SECRET in production")
+	}
+
 	templates := loadTemplates() // Load templates
 
+	db, err := storage.OpenSQLite(cfg.Server.DatabasePath) // Open the database
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	users := storage.NewSQLiteUserStore(db)
+	handlers.UseTokenManager(auth.NewTokenManager(auth.TokenConfig{
+		Secret:               []byte(cfg.Auth.JWTSecret),
+		Issuer:               cfg.Auth.Issuer,
+		Audience:             cfg.Auth.Audience,
+		AccessTokenLifetime:  cfg.Auth.AccessTokenLifetime,
+		RefreshTokenLifetime: cfg.Auth.RefreshTokenLifetime,
+	}, storage.NewSQLiteRevocationStore(db))) // Remember revoked tokens across restarts
+	clientConfig := chat.ClientConfig{ // Outbound queue of every WebSocket connection
+		SendQueueSize:  cfg.WebSocket.SendQueueSize,
+		WriteTimeout:   cfg.WebSocket.WriteTimeout,
+		OverflowPolicy: chat.OverflowPolicy(cfg.WebSocket.SlowConsumerPolicy),
+		PingInterval:   cfg.WebSocket.PingInterval,
+		PongTimeout:    cfg.WebSocket.PongTimeout,
+		MaxMessageSize: int64(cfg.WebSocket.MaxMessageSize),
+	}
+	messages := storage.NewSQLiteMessageStore(db)
+	hub := chat.NewHub(messages) // Create the chat rooms, each room broadcasts and stores its own messages
+
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static")))) // Serve static files
 
-	http.HandleFunc("/", handlers.ServeHome(templates))               // Serve index
-	http.HandleFunc("/register", handlers.RegisterHandler(templates)) // Register user
-	http.HandleFunc("/login", handlers.LoginHandler(templates))       // Login user
-	http.HandleFunc("/chat", handlers.ServeChat(templates))           // Serve chat
+	http.HandleFunc("/", handlers.ServeHome(templates))                      // Serve index
+	http.HandleFunc("/register", handlers.RegisterHandler(templates, users)) // Register user
+	http.HandleFunc("/login", handlers.LoginHandler(templates, users))       // Login user
+	http.HandleFunc("/token/refresh", handlers.RefreshTokenHandler(users))   // Refresh tokens
+	http.HandleFunc("/logout", handlers.LogoutHandler(hub))                  // Logout user
+	http.HandleFunc("/chat", handlers.ServeChat(templates, hub))             // Serve chat
+	http.HandleFunc("/rooms", handlers.CreateRoom(hub))                      // Create room
+
+	http.HandleFunc("/api/rooms/", handlers.ServeRoomMessages(hub, messages)) // Serve room history
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	b := newBroker(ctx, cfg) // Talk to the bots over RabbitMQ or in process
+
+	http.HandleFunc("/ws", handlers.ServeWebSocket(hub, clientConfig, b, cfg.Server.PrivateStockReplies)) // Serve websocket, publishing stock requests for the bots
+
+	handlers.ConsumeStockQuotes(hub, b) // Consume stock quotes, again after every reconnection
+
+	http.HandleFunc("/healthz", health.Serve(b)) // Report the broker connection state
+
+	if cfg.Server.RelayMessages {
+		handlers.RelayMessages(ctx, hub, b) // Share messages with the other chat servers
+	}
+
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		b.Run(ctx) // Connect to the broker, reconnecting until shutdown
+	}()
+
+	server := &http.Server{Addr: cfg.Server.Addr}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe() // Start server
+	}()
+	fmt.Printf("Server started on %s\n", cfg.Server.Addr)
+
+	select {
+	case err := <-serverErr:
+		log.Printf("Server stopped: %v", err)
+	case <-ctx.Done():
+		log.Println("Shutting down")
+	}
+	stop()
+
+	shutdown(cfg.Server.ShutdownTimeout, server, hub, consumerDone)
+
+	// Every message is stored before it is broadcast, closing the database flushes them
+	if err := db.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+}
+
+// shutdown stops accepting connections, waits for the stock quote consumer,
+// then closes the WebSockets once the messages already broadcast are written,
+// giving up after timeout
+func shutdown(timeout time.Duration, server *http.Server, hub *chat.Hub, consumerDone <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// WebSockets are hijacked connections, Shutdown leaves them to the hub
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Failed to shut down HTTP server: %v", err)
+	}
+
+	select {
+	case <-consumerDone:
+	case <-ctx.Done():
+		log.Println("Timed out waiting for the stock quote consumer")
+	}
+
+	if err := hub.Shutdown(ctx, "server shutting down"); err != nil {
+		log.Printf("Closed the remaining WebSockets without waiting: %v", err)
+	}
+}
 
-	http.HandleFunc("/ws", handlers.ServeWebSocket) // Serve websocket
+// newBroker returns the broker configured to reach the bots. With the
+// in-process broker the server answers the stock requests itself until ctx
+// is done.
+func newBroker(ctx context.Context, cfg *config.Config) broker.Broker {
+	if cfg.Broker.Driver == config.BrokerMemory {
+		quotes, err := bot.NewQuoteProvider(cfg.Bot)
+		if err != nil {
+			log.Fatalf("Failed to set up the stock quote providers: %v", err)
+		}
 
-	go handlers.HandleMessages()     // Start handling and broadcasting messages
-	go handlers.ConsumeStockQuotes() // Start consuming stock quotes
+		b := broker.NewMemory()
+		bot.Serve(ctx, b, quotes)
+		log.Println("Using the in-process broker, the stock bot runs inside the server")
+		return b
+	}
 
-	fmt.Println("Server started on :8080")
-	http.ListenAndServe(":8080", nil) // Start server
+	return rabbitmq.New(rabbitmq.Config{
+		URL:        cfg.RabbitMQ.URL,
+		MinBackoff: cfg.RabbitMQ.MinBackoff,
+		MaxBackoff: cfg.RabbitMQ.MaxBackoff,
+		Confirm:    true, // only acknowledge stock commands once the broker has them
+	})
 }
 
 func loadTemplates() *template.Template {
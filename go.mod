@@ -4,9 +4,11 @@ go 1.20
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
-	github.com/gorilla/sessions v1.2.1
 	github.com/gorilla/websocket v1.5.0
+	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/streadway/amqp v1.1.0
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/gorilla/securecookie v1.1.1 // indirect
+require golang.org/x/sys v0.13.0 // indirect
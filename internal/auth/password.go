@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// PasswordHasher hashes passwords into self-describing encoded strings
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password, including algorithm and cost parameters
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+	// Recognizes reports whether encoded was produced by this hasher's algorithm
+	Recognizes(encoded string) bool
+	// NeedsRehash reports whether encoded uses weaker parameters than the hasher is configured with
+	NeedsRehash(encoded string) bool
+}
+
+// Passwords hashes new passwords with a preferred hasher and verifies
+// hashes produced by it or by any of the legacy hashers
+type Passwords struct {
+	preferred PasswordHasher
+	hashers   []PasswordHasher
+}
+
+// NewPasswords creates Passwords hashing with preferred and still accepting legacy hashes
+func NewPasswords(preferred PasswordHasher, legacy ...PasswordHasher) *Passwords {
+	return &Passwords{
+		preferred: preferred,
+		hashers:   append([]PasswordHasher{preferred}, legacy...),
+	}
+}
+
+// DefaultPasswords hashes with argon2id and upgrades bcrypt and MD5 hashes
+func DefaultPasswords() *Passwords {
+	return NewPasswords(NewArgon2idHasher(DefaultArgon2idParams), NewBcryptHasher(DefaultBcryptCost), MD5Hasher{})
+}
+
+// Hash hashes password with the preferred hasher
+func (p *Passwords) Hash(password string) (string, error) {
+	return p.preferred.Hash(password)
+}
+
+// Verify checks password against encoded. When the password matches but
+// encoded uses a legacy algorithm or outdated parameters, upgraded holds a
+// fresh hash from the preferred hasher that should replace the stored one.
+func (p *Passwords) Verify(password, encoded string) (ok bool, upgraded string, err error) {
+	for _, hasher := range p.hashers {
+		if !hasher.Recognizes(encoded) {
+			continue
+		}
+
+		ok, err = hasher.Verify(password, encoded)
+		if err != nil || !ok {
+			return false, "", err
+		}
+
+		if hasher != p.preferred || p.preferred.NeedsRehash(encoded) {
+			upgraded, err = p.preferred.Hash(password)
+			if err != nil {
+				return true, "", err
+			}
+		}
+
+		return true, upgraded, nil
+	}
+
+	return false, "", ErrUnknownHashFormat
+}
+
+// MD5Hasher verifies the unsalted hex MD5 hashes stored by early versions of the app.
+// It only exists so those hashes can be upgraded and should never be preferred.
+type MD5Hasher struct{}
+
+func (MD5Hasher) Hash(password string) (string, error) {
+	sum := md5.Sum([]byte(password))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (h MD5Hasher) Verify(password, encoded string) (bool, error) {
+	hash, _ := h.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(encoded)) == 1, nil
+}
+
+func (MD5Hasher) Recognizes(encoded string) bool {
+	if len(encoded) != hex.EncodedLen(md5.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+func (MD5Hasher) NeedsRehash(encoded string) bool {
+	return true
+}
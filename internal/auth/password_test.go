@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2idParams = Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestPasswordHashers(t *testing.T) {
+	testCases := []struct {
+		name   string
+		hasher PasswordHasher
+		prefix string
+	}{
+		{"bcrypt", NewBcryptHasher(bcrypt.MinCost), "$2a$04$"},
+		{"argon2id", NewArgon2idHasher(testArgon2idParams), "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{"md5", MD5Hasher{}, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded, err := tc.hasher.Hash("s3cret")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.HasPrefix(encoded, tc.prefix) {
+				t.Errorf("unexpected encoding: got %v, want prefix %v", encoded, tc.prefix)
+			}
+			if !tc.hasher.Recognizes(encoded) {
+				t.Errorf("hasher does not recognize its own hash %v", encoded)
+			}
+
+			if ok, err := tc.hasher.Verify("s3cret", encoded); err != nil || !ok {
+				t.Errorf("expected password to verify, got %v, %v", ok, err)
+			}
+			if ok, err := tc.hasher.Verify("wrong", encoded); err != nil || ok {
+				t.Errorf("expected wrong password to fail, got %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weakBcrypt, _ := NewBcryptHasher(bcrypt.MinCost).Hash("s3cret")
+	if !NewBcryptHasher(bcrypt.MinCost + 1).NeedsRehash(weakBcrypt) {
+		t.Error("expected bcrypt hash with lower cost to need a rehash")
+	}
+	if NewBcryptHasher(bcrypt.MinCost).NeedsRehash(weakBcrypt) {
+		t.Error("expected bcrypt hash with same cost not to need a rehash")
+	}
+
+	weakArgon2id, _ := NewArgon2idHasher(testArgon2idParams).Hash("s3cret")
+	stronger := testArgon2idParams
+	stronger.Iterations = 2
+	if !NewArgon2idHasher(stronger).NeedsRehash(weakArgon2id) {
+		t.Error("expected argon2id hash with fewer iterations to need a rehash")
+	}
+	if NewArgon2idHasher(testArgon2idParams).NeedsRehash(weakArgon2id) {
+		t.Error("expected argon2id hash with same parameters not to need a rehash")
+	}
+}
+
+func TestPasswords_Verify(t *testing.T) {
+	preferred := NewArgon2idHasher(testArgon2idParams)
+	passwords := NewPasswords(preferred, NewBcryptHasher(bcrypt.MinCost), MD5Hasher{})
+
+	current, _ := preferred.Hash("s3cret")
+	legacyBcrypt, _ := NewBcryptHasher(bcrypt.MinCost).Hash("s3cret")
+	legacyMD5, _ := MD5Hasher{}.Hash("s3cret")
+
+	testCases := []struct {
+		name          string
+		encoded       string
+		password      string
+		shouldMatch   bool
+		shouldUpgrade bool
+	}{
+		{"current", current, "s3cret", true, false},
+		{"bcrypt", legacyBcrypt, "s3cret", true, true},
+		{"md5", legacyMD5, "s3cret", true, true},
+		{"md5 wrong password", legacyMD5, "wrong", false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, upgraded, err := passwords.Verify(tc.password, tc.encoded)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tc.shouldMatch {
+				t.Errorf("unexpected match: got %v, want %v", ok, tc.shouldMatch)
+			}
+			if (upgraded != "") != tc.shouldUpgrade {
+				t.Errorf("unexpected upgrade: got %q", upgraded)
+			}
+			if upgraded != "" && !preferred.Recognizes(upgraded) {
+				t.Errorf("upgraded hash does not use the preferred hasher: %v", upgraded)
+			}
+		})
+	}
+
+	if _, _, err := passwords.Verify("s3cret", "plaintext"); !errors.Is(err, ErrUnknownHashFormat) {
+		t.Errorf("expected ErrUnknownHashFormat, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+// Token types, stored in the "typ" claim so one kind cannot be used as the other
+const (
+	AccessToken  = "access"
+	RefreshToken = "refresh"
+)
+
+var (
+	ErrTokenInvalid       = errors.New("invalid token")
+	ErrTokenExpired       = errors.New("token expired")
+	ErrTokenNotYetValid   = errors.New("token not valid yet")
+	ErrTokenWrongIssuer   = errors.New("token issued by an unexpected issuer")
+	ErrTokenWrongAudience = errors.New("token meant for another audience")
+	ErrTokenWrongType     = errors.New("unexpected token type")
+	ErrTokenRevoked       = errors.New("token revoked")
+	ErrAccountDisabled    = errors.New("account disabled")
+)
+
+// TokenConfig configures the tokens issued and accepted by a TokenManager
+type TokenConfig struct {
+	Secret               []byte
+	Issuer               string
+	Audience             string
+	AccessTokenLifetime  time.Duration
+	RefreshTokenLifetime time.Duration
+}
+
+// DefaultTokenConfig returns short lived access tokens and week long refresh tokens signed with secret
+func DefaultTokenConfig(secret []byte) TokenConfig {
+	return TokenConfig{
+		Secret:               secret,
+		Issuer:               "chat-app",
+		Audience:             "chat-app",
+		AccessTokenLifetime:  15 * time.Minute,
+		RefreshTokenLifetime: 7 * 24 * time.Hour,
+	}
+}
+
+// Claims are the claims of the tokens issued by a TokenManager
+type Claims struct {
+	Username  string `json:"username"`
+	TokenType string `json:"typ"`
+	jwt.StandardClaims
+}
+
+// TokenPair is the result of logging in or refreshing
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	AccessClaims *Claims
+}
+
+// TokenManager issues and validates HS256 signed JWT access and refresh tokens.
+// Tokens can be revoked before they expire, refresh tokens are rotated by
+// revoking each one as soon as it is exchanged for a new pair.
+type TokenManager struct {
+	config      TokenConfig
+	revocations storage.RevocationStore
+	now         func() time.Time
+
+	refreshMu sync.Mutex // makes checking and revoking a refresh token atomic
+}
+
+// NewTokenManager creates a TokenManager with the given configuration, keeping revoked token IDs in revocations
+func NewTokenManager(config TokenConfig, revocations storage.RevocationStore) *TokenManager {
+	return &TokenManager{
+		config:      config,
+		revocations: revocations,
+		now:         time.Now,
+	}
+}
+
+// Config returns the configuration of the manager
+func (m *TokenManager) Config() TokenConfig {
+	return m.config
+}
+
+// Issue creates a new access and refresh token pair for username
+func (m *TokenManager) Issue(username string) (TokenPair, error) {
+	access, accessClaims, err := m.generate(username, AccessToken, m.config.AccessTokenLifetime)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refresh, _, err := m.generate(username, RefreshToken, m.config.RefreshTokenLifetime)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{AccessToken: access, RefreshToken: refresh, AccessClaims: accessClaims}, nil
+}
+
+// GenerateAccessToken creates an access token for username
+func (m *TokenManager) GenerateAccessToken(username string) (string, *Claims, error) {
+	return m.generate(username, AccessToken, m.config.AccessTokenLifetime)
+}
+
+// ParseAccessToken validates an access token and returns its claims
+func (m *TokenManager) ParseAccessToken(tokenString string) (*Claims, error) {
+	return m.parse(tokenString, AccessToken)
+}
+
+// Refresh exchanges a refresh token for a new pair. The refresh token is revoked,
+// presenting it again fails with ErrTokenRevoked. When check is not nil it is
+// asked whether the account of the token may still log in, the error it
+// returns refuses the refresh.
+func (m *TokenManager) Refresh(refreshToken string, check func(username string) error) (TokenPair, error) {
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+
+	claims, err := m.parse(refreshToken, RefreshToken)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if check != nil {
+		if err := check(claims.Username); err != nil {
+			return TokenPair{}, err
+		}
+	}
+
+	if err := m.revoke(claims); err != nil {
+		return TokenPair{}, err
+	}
+
+	return m.Issue(claims.Username)
+}
+
+// Revoke revokes a token of any type until its expiry. Tokens that are already
+// invalid, expired or revoked are left alone.
+func (m *TokenManager) Revoke(tokenString string) error {
+	claims, err := m.parse(tokenString, "")
+	if err != nil {
+		return nil
+	}
+
+	return m.revoke(claims)
+}
+
+func (m *TokenManager) revoke(claims *Claims) error {
+	if err := m.revocations.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+		return err
+	}
+
+	// Revoked tokens only need to be remembered until they expire anyway
+	return m.revocations.PruneExpired(m.now())
+}
+
+func (m *TokenManager) generate(username, tokenType string, lifetime time.Duration) (string, *Claims, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := m.now()
+	claims := &Claims{
+		Username:  username,
+		TokenType: tokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			Issuer:    m.config.Issuer,
+			Audience:  m.config.Audience,
+			Subject:   username,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+		},
+	}
+
+	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.config.Secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return tokenString, claims, nil
+}
+
+// parse validates a token of tokenType, any type is accepted if tokenType is empty
+func (m *TokenManager) parse(tokenString, tokenType string) (*Claims, error) {
+	// The time based claims are checked below against the manager's clock
+	parser := jwt.Parser{SkipClaimsValidation: true}
+
+	claims := &Claims{}
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return m.config.Secret, nil
+	})
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	now := m.now().Unix()
+	switch {
+	case claims.Id == "" || claims.Username == "":
+		return nil, ErrTokenInvalid
+	case !claims.VerifyExpiresAt(now, true):
+		return nil, ErrTokenExpired
+	case !claims.VerifyNotBefore(now, true), !claims.VerifyIssuedAt(now, true):
+		return nil, ErrTokenNotYetValid
+	case !claims.VerifyIssuer(m.config.Issuer, true):
+		return nil, ErrTokenWrongIssuer
+	case !claims.VerifyAudience(m.config.Audience, true):
+		return nil, ErrTokenWrongAudience
+	case tokenType != "" && claims.TokenType != tokenType:
+		return nil, ErrTokenWrongType
+	}
+
+	revoked, err := m.revocations.IsRevoked(claims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
+}
+
+// newTokenID returns a random token ID for the jti claim
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+func newTestTokenManager(now time.Time) *TokenManager {
+	manager := NewTokenManager(DefaultTokenConfig([]byte("test-secret")), storage.NewMemoryRevocationStore())
+	manager.now = func() time.Time { return now }
+	return manager
+}
+
+func TestTokenManager_ParseAccessToken(t *testing.T) {
+	now := time.Now()
+	manager := newTestTokenManager(now)
+	pair, err := manager.Issue("testuser")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	revocations := storage.NewMemoryRevocationStore()
+	otherIssuer := NewTokenManager(TokenConfig{Secret: []byte("test-secret"), Issuer: "someone-else", Audience: "chat-app", AccessTokenLifetime: time.Minute}, revocations)
+	otherAudience := NewTokenManager(TokenConfig{Secret: []byte("test-secret"), Issuer: "chat-app", Audience: "another-app", AccessTokenLifetime: time.Minute}, revocations)
+	otherSecret := NewTokenManager(DefaultTokenConfig([]byte("other-secret")), revocations)
+	wrongIssuer, _, _ := otherIssuer.GenerateAccessToken("testuser")
+	wrongAudience, _, _ := otherAudience.GenerateAccessToken("testuser")
+	wrongSecret, _, _ := otherSecret.GenerateAccessToken("testuser")
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"username": "testuser"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	testCases := []struct {
+		name        string
+		parseAt     time.Time
+		token       string
+		expectedErr error
+	}{
+		{"valid", now, pair.AccessToken, nil},
+		{"expired", now.Add(16 * time.Minute), pair.AccessToken, ErrTokenExpired},
+		{"not yet valid", now.Add(-time.Minute), pair.AccessToken, ErrTokenNotYetValid},
+		{"wrong issuer", now, wrongIssuer, ErrTokenWrongIssuer},
+		{"wrong audience", now, wrongAudience, ErrTokenWrongAudience},
+		{"wrong secret", now, wrongSecret, ErrTokenInvalid},
+		{"unsigned", now, unsigned, ErrTokenInvalid},
+		{"refresh token", now, pair.RefreshToken, ErrTokenWrongType},
+		{"garbage", now, "invalid-token", ErrTokenInvalid},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			manager.now = func() time.Time { return tc.parseAt }
+
+			claims, err := manager.ParseAccessToken(tc.token)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected error: got %v, want %v", err, tc.expectedErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if claims.Username != "testuser" || claims.Id == "" || claims.Issuer != "chat-app" || claims.Audience != "chat-app" {
+				t.Errorf("unexpected claims: %+v", claims)
+			}
+			if claims.IssuedAt != now.Unix() || claims.NotBefore != now.Unix() || claims.ExpiresAt != now.Add(15*time.Minute).Unix() {
+				t.Errorf("unexpected token lifetime: %+v", claims.StandardClaims)
+			}
+		})
+	}
+}
+
+func TestTokenManager_Refresh(t *testing.T) {
+	now := time.Now()
+	manager := newTestTokenManager(now)
+	pair, _ := manager.Issue("testuser")
+
+	if _, err := manager.Refresh(pair.AccessToken, nil); !errors.Is(err, ErrTokenWrongType) {
+		t.Errorf("expected access token to be refused for refresh, got %v", err)
+	}
+
+	rotated, err := manager.Refresh(pair.RefreshToken, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotated.RefreshToken == pair.RefreshToken || rotated.AccessToken == pair.AccessToken {
+		t.Error("expected a new token pair")
+	}
+	if claims, err := manager.ParseAccessToken(rotated.AccessToken); err != nil || claims.Username != "testuser" {
+		t.Errorf("unexpected refreshed access token: %+v, %v", claims, err)
+	}
+
+	// The old refresh token was rotated away
+	if _, err := manager.Refresh(pair.RefreshToken, nil); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked, got %v", err)
+	}
+
+	// Accounts that may no longer log in cannot refresh
+	refuse := func(username string) error { return ErrAccountDisabled }
+	if _, err := manager.Refresh(rotated.RefreshToken, refuse); !errors.Is(err, ErrAccountDisabled) {
+		t.Errorf("expected ErrAccountDisabled, got %v", err)
+	}
+
+	// Refresh tokens expire as well
+	manager.now = func() time.Time { return now.Add(8 * 24 * time.Hour) }
+	if _, err := manager.Refresh(rotated.RefreshToken, nil); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestTokenManager_Revoke(t *testing.T) {
+	manager := newTestTokenManager(time.Now())
+	pair, _ := manager.Issue("testuser")
+	other, _ := manager.Issue("testuser")
+
+	if err := manager.Revoke(pair.AccessToken); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.Revoke(pair.RefreshToken); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.Revoke("invalid-token"); err != nil {
+		t.Errorf("revoking an invalid token should be a no-op, got %v", err)
+	}
+
+	if _, err := manager.ParseAccessToken(pair.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked, got %v", err)
+	}
+	if _, err := manager.Refresh(pair.RefreshToken, nil); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked, got %v", err)
+	}
+
+	// Other sessions of the same user are not affected
+	if _, err := manager.ParseAccessToken(other.AccessToken); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
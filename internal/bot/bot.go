@@ -0,0 +1,112 @@
+// Package bot answers the stock requests of the chat server with stock quotes.
+//
+// The standalone bot serves it over RabbitMQ, the chat server runs it in
+// process when it uses the in-process broker.
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+	"github.com/andrerussowsky/chat-app/internal/config"
+	"github.com/andrerussowsky/chat-app/internal/stock"
+)
+
+// Serve declares the stock queues on b and answers every stock request
+// published on it with a quote of quotes. Every bot serving the same broker
+// takes its share of the requests. Once ctx is done the quotes being fetched
+// are given up and their requests requeued.
+func Serve(ctx context.Context, b broker.Broker, quotes QuoteProvider) {
+	b.Declare(stock.RequestQueue)
+	b.Declare(stock.QuoteQueue)
+
+	b.Subscribe(stock.RequestQueue.Name, func(d broker.Delivery) error {
+		return answerStockRequest(ctx, b, quotes, d)
+	})
+}
+
+// answerStockRequest publishes the quote asked for by a stock request, back
+// to the room and user that asked. Every request is answered: when there is
+// no quote the reply tells why, once a failure that may be transient was
+// retried.
+func answerStockRequest(ctx context.Context, b broker.Broker, quotes QuoteProvider, d broker.Delivery) error {
+	request, err := stock.DecodeRequest(d)
+	if err != nil {
+		return err
+	}
+
+	var reply stock.Reply
+	quote, err := quotes.Quote(ctx, request.StockCode)
+	if err == nil {
+		reply = request.Reply(quote.String())
+	} else if ctx.Err() != nil {
+		return fmt.Errorf("getting the quote for stock request %s: %w", request.CorrelationID, ctx.Err())
+	} else {
+		code, content := quoteFailure(request.StockCode, err)
+		if code == stock.ErrorUnavailable && d.Attempts == 0 {
+			return fmt.Errorf("getting the quote for stock request %s: %w", request.CorrelationID, err)
+		}
+		log.Printf("No quote for stock request %s (%s): %v", request.CorrelationID, code, err)
+		reply = request.Fail(code, content)
+	}
+
+	msg, err := reply.Message()
+	if err != nil {
+		return err
+	}
+	if err := b.Publish(request.ReplyQueue(), msg); err != nil {
+		return fmt.Errorf("publishing the reply to stock request %s: %w", request.CorrelationID, err)
+	}
+
+	return nil
+}
+
+// quoteFailure categorizes the reason there is no quote for symbol and
+// returns the message telling the user about it. The failures of the quote
+// source itself come first, as a fallback source not knowing the symbol does
+// not mean the first one would not have.
+func quoteFailure(symbol string, err error) (stock.ErrorCode, string) {
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return stock.ErrorRateLimited, fmt.Sprintf("Sorry, I cannot ask for more quotes right now. Please ask for %s again later.", symbol)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &timeout) && timeout.Timeout():
+		return stock.ErrorTimeout, fmt.Sprintf("Sorry, the quote for %s is taking too long. Please try again later.", symbol)
+	case errors.Is(err, ErrUnknownSymbol):
+		return stock.ErrorUnknownSymbol, fmt.Sprintf("Sorry, I could not find a stock called %s. Stock codes look like AAPL.US.", symbol)
+	case errors.Is(err, ErrMalformedQuote), errors.Is(err, ErrInvalidField):
+		return stock.ErrorUnreadableQuote, fmt.Sprintf("Sorry, the quote for %s could not be read. Please try again later.", symbol)
+	default:
+		return stock.ErrorUnavailable, fmt.Sprintf("Sorry, I could not get the quote for %s. Please try again later.", symbol)
+	}
+}
+
+// NewQuoteProvider creates the quote providers configured for the bot, asked
+// in order through a cache
+func NewQuoteProvider(cfg config.BotConfig) (QuoteProvider, error) {
+	var providers []QuoteProvider
+	for _, name := range strings.Split(cfg.QuoteProviders, ",") {
+		switch strings.TrimSpace(name) {
+		case config.QuoteProviderStooq:
+			providers = append(providers, NewStooqProvider(cfg.StooqURL))
+		case config.QuoteProviderFixture:
+			fixture, err := LoadFixture(cfg.QuoteFixture)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, fixture)
+		default:
+			return nil, fmt.Errorf("unknown quote provider %q", name)
+		}
+	}
+
+	var provider QuoteProvider = &FallbackProvider{Providers: providers, Timeout: cfg.QuoteTimeout}
+	if cfg.QuoteCacheTTL > 0 {
+		provider = NewCachedProvider(provider, cfg.QuoteCacheTTL)
+	}
+	return provider, nil
+}
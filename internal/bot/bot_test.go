@@ -0,0 +1,148 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+	"github.com/andrerussowsky/chat-app/internal/stock"
+)
+
+func TestServe(t *testing.T) {
+	b := broker.NewMemory()
+	fixture := FixtureProvider{"AAPL.US": {Symbol: "AAPL.US", Close: 93.42}}
+	Serve(context.Background(), b, providerFunc(func(ctx context.Context, symbol string) (Quote, error) {
+		if symbol == "DOWN.US" {
+			return Quote{}, errors.New("stooq is down")
+		}
+		return fixture.Quote(ctx, symbol)
+	}))
+
+	replies := make(chan stock.Reply, 2)
+	b.Subscribe(stock.QuoteQueue.Name, func(d broker.Delivery) error {
+		reply, err := stock.DecodeReply(d)
+		if err != nil {
+			return err
+		}
+		replies <- reply
+		return nil
+	})
+	dead := make(chan broker.Delivery, 1)
+	b.Subscribe(stock.RequestQueue.DeadLetter, func(d broker.Delivery) error {
+		dead <- d
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	request := stock.NewRequest("testuser", "project-x", "AAPL.US")
+	msg, err := request.Message()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := b.Publish(stock.RequestQueue.Name, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case reply := <-replies:
+		if expected := request.Reply("AAPL.US quote is $93.42 per share"); reply != expected {
+			t.Errorf("unexpected reply: got %+v want %+v", reply, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the reply")
+	}
+
+	// Failures are answered with the reason there is no quote, once retried
+	for _, tc := range []struct {
+		symbol  string
+		code    stock.ErrorCode
+		content string
+	}{
+		{"XYZ.US", stock.ErrorUnknownSymbol, "Sorry, I could not find a stock called XYZ.US. Stock codes look like AAPL.US."},
+		{"DOWN.US", stock.ErrorUnavailable, "Sorry, I could not get the quote for DOWN.US. Please try again later."},
+	} {
+		request := stock.NewRequest("testuser", "project-x", tc.symbol)
+		msg, _ := request.Message()
+		if err := b.Publish(stock.RequestQueue.Name, msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		select {
+		case reply := <-replies:
+			if expected := request.Fail(tc.code, tc.content); reply != expected {
+				t.Errorf("unexpected reply: got %+v want %+v", reply, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for the reply to %s", tc.symbol)
+		}
+	}
+
+	// Requests that cannot be read end up in the dead-letter queue
+	if err := b.Publish(stock.RequestQueue.Name, broker.Message{CorrelationID: "abc", Body: []byte("AAPL.US")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case d := <-dead:
+		if d.CorrelationID != "abc" {
+			t.Errorf("unexpected dead letter: %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the dead letter")
+	}
+}
+
+func TestQuoteFailure(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected stock.ErrorCode
+	}{
+		{fmt.Errorf("%w: XYZ.US", ErrUnknownSymbol), stock.ErrorUnknownSymbol},
+		{fmt.Errorf("%w: no quote after the header", ErrMalformedQuote), stock.ErrorUnreadableQuote},
+		{fmt.Errorf("%w: AAPL.US close \"x\"", ErrInvalidField), stock.ErrorUnreadableQuote},
+		{fmt.Errorf("%w: stooq answered 429 Too Many Requests", ErrRateLimited), stock.ErrorRateLimited},
+		{&url.Error{Op: "Get", URL: "https://stooq.com/q/l/", Err: context.DeadlineExceeded}, stock.ErrorTimeout},
+		{errors.New("connection refused"), stock.ErrorUnavailable},
+		// The quote source timing out says nothing about the symbol
+		{errors.Join(context.DeadlineExceeded, ErrUnknownSymbol), stock.ErrorTimeout},
+	}
+
+	for _, tc := range testCases {
+		if code, content := quoteFailure("AAPL.US", tc.err); code != tc.expected || content == "" {
+			t.Errorf("unexpected failure for %v: got %q, %q want %q", tc.err, code, content, tc.expected)
+		}
+	}
+}
+
+func TestAnswerStockRequest_Shutdown(t *testing.T) {
+	b := broker.NewMemory()
+	b.Declare(stock.QuoteQueue)
+
+	// The quote is being fetched when the bot shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	quotes := providerFunc(func(ctx context.Context, symbol string) (Quote, error) {
+		cancel()
+		<-ctx.Done()
+		return Quote{}, ctx.Err()
+	})
+
+	msg, _ := stock.NewRequest("testuser", "project-x", "AAPL.US").Message()
+	err := answerStockRequest(ctx, b, quotes, broker.Delivery{Message: msg, Attempts: 1})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the request to be given up, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedProvider remembers the quotes of its provider for TTL, so that a
+// symbol asked for repeatedly is fetched once
+type CachedProvider struct {
+	provider QuoteProvider
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	quotes map[string]cachedQuote // by upper case symbol
+}
+
+// cachedQuote is a quote and when it stops being served from the cache
+type cachedQuote struct {
+	quote   Quote
+	expires time.Time
+}
+
+// NewCachedProvider caches the quotes of provider for ttl, errors are not cached
+func NewCachedProvider(provider QuoteProvider, ttl time.Duration) *CachedProvider {
+	return &CachedProvider{
+		provider: provider,
+		ttl:      ttl,
+		now:      time.Now,
+		quotes:   make(map[string]cachedQuote),
+	}
+}
+
+func (p *CachedProvider) Quote(ctx context.Context, symbol string) (Quote, error) {
+	key := strings.ToUpper(symbol)
+
+	p.mu.Lock()
+	cached, ok := p.quotes[key]
+	p.mu.Unlock()
+	if ok && p.now().Before(cached.expires) {
+		return cached.quote, nil
+	}
+
+	q, err := p.provider.Quote(ctx, symbol)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.quotes[key] = cachedQuote{quote: q, expires: p.now().Add(p.ttl)}
+	p.removeExpired()
+
+	return q, nil
+}
+
+// removeExpired drops the quotes that expired, holding mu
+func (p *CachedProvider) removeExpired() {
+	now := p.now()
+	for key, cached := range p.quotes {
+		if !now.Before(cached.expires) {
+			delete(p.quotes, key)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package bot
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedQuote = errors.New("malformed quote")
+	ErrInvalidField   = errors.New("invalid quote field")
+)
+
+// noData is what stooq puts in every field of a symbol it does not know
+const noData = "N/D"
+
+// quoteColumns are the columns of a stooq CSV file, found by name in its header
+var quoteColumns = []string{"Symbol", "Date", "Time", "Open", "High", "Low", "Close", "Volume"}
+
+// parseQuotes reads the quotes of a CSV file in the stooq format. Symbols
+// stooq does not know are reported as ErrUnknownSymbol, rows that cannot be
+// read as ErrMalformedQuote and values that are not what their column holds
+// as ErrInvalidField.
+func parseQuotes(r io.Reader) ([]Quote, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // checked against the header below
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: empty CSV", ErrMalformedQuote)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedQuote, err)
+	}
+	columns, err := columnIndexes(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotes []Quote
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedQuote, err)
+		}
+		if len(record) != len(header) {
+			return nil, fmt.Errorf("%w: row has %d fields, the header %d", ErrMalformedQuote, len(record), len(header))
+		}
+
+		q, err := parseQuote(record, columns)
+		if err != nil {
+			return nil, err
+		}
+		quotes = append(quotes, q)
+	}
+	if len(quotes) == 0 {
+		return nil, fmt.Errorf("%w: no quote after the header", ErrMalformedQuote)
+	}
+
+	return quotes, nil
+}
+
+// columnIndexes returns the index of every quote column in header
+func columnIndexes(header []string) (map[string]int, error) {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for _, name := range quoteColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: missing %s column", ErrMalformedQuote, name)
+		}
+	}
+	return columns, nil
+}
+
+// parseQuote reads a row of a stooq CSV file
+func parseQuote(record []string, columns map[string]int) (Quote, error) {
+	field := func(name string) string {
+		return strings.TrimSpace(record[columns[name]])
+	}
+
+	q := Quote{Symbol: field("Symbol")}
+	if q.Symbol == "" {
+		return Quote{}, fmt.Errorf("%w: missing symbol", ErrMalformedQuote)
+	}
+	if field("Date") == noData || field("Close") == noData {
+		return Quote{}, fmt.Errorf("%w: %s", ErrUnknownSymbol, q.Symbol)
+	}
+
+	var err error
+	q.Time, err = time.Parse(time.DateTime, field("Date")+" "+field("Time"))
+	if err != nil {
+		return Quote{}, fmt.Errorf("%w: %s date %q and time %q", ErrInvalidField, q.Symbol, field("Date"), field("Time"))
+	}
+
+	prices := []struct {
+		name  string
+		value *float64
+	}{
+		{"Open", &q.Open},
+		{"High", &q.High},
+		{"Low", &q.Low},
+		{"Close", &q.Close},
+	}
+	for _, price := range prices {
+		*price.value, err = strconv.ParseFloat(field(price.name), 64)
+		if err != nil {
+			return Quote{}, fmt.Errorf("%w: %s %s %q", ErrInvalidField, q.Symbol, strings.ToLower(price.name), field(price.name))
+		}
+	}
+
+	// Indexes and currencies have no volume
+	if volume := field("Volume"); volume != "" && volume != noData {
+		q.Volume, err = strconv.ParseInt(volume, 10, 64)
+		if err != nil {
+			return Quote{}, fmt.Errorf("%w: %s volume %q", ErrInvalidField, q.Symbol, volume)
+		}
+	}
+
+	return q, nil
+}
@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const quoteHeader = "Symbol,Date,Time,Open,High,Low,Close,Volume\n"
+
+func TestParseQuotes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		csv      string
+		expected Quote
+		err      error
+	}{
+		{
+			name: "stock",
+			csv:  quoteHeader + "AAPL.US,2023-07-03,22:00:07,193.78,193.88,191.76,192.46,31458198\n",
+			expected: Quote{
+				Symbol: "AAPL.US",
+				Time:   time.Date(2023, 7, 3, 22, 0, 7, 0, time.UTC),
+				Open:   193.78, High: 193.88, Low: 191.76, Close: 192.46,
+				Volume: 31458198,
+			},
+		},
+		{
+			name: "columns found by name",
+			csv:  "Symbol,Close,Date,Time,Open,High,Low,Volume\nAAPL.US,192.46,2023-07-03,22:00:07,193.78,193.88,191.76,31458198\n",
+			expected: Quote{
+				Symbol: "AAPL.US",
+				Time:   time.Date(2023, 7, 3, 22, 0, 7, 0, time.UTC),
+				Open:   193.78, High: 193.88, Low: 191.76, Close: 192.46,
+				Volume: 31458198,
+			},
+		},
+		{
+			name: "index without volume",
+			csv:  quoteHeader + "^SPX,2023-07-03,19:00:00,4450.48,4456.46,4442.29,4455.59,N/D\n",
+			expected: Quote{
+				Symbol: "^SPX",
+				Time:   time.Date(2023, 7, 3, 19, 0, 0, 0, time.UTC),
+				Open:   4450.48, High: 4456.46, Low: 4442.29, Close: 4455.59,
+			},
+		},
+		{name: "unknown symbol", csv: quoteHeader + "XYZ.US,N/D,N/D,N/D,N/D,N/D,N/D,N/D\n", err: ErrUnknownSymbol},
+		{name: "empty", csv: "", err: ErrMalformedQuote},
+		{name: "header only", csv: quoteHeader, err: ErrMalformedQuote},
+		{name: "missing column", csv: "Symbol,Date,Time,Close\nAAPL.US,2023-07-03,22:00:07,192.46\n", err: ErrMalformedQuote},
+		{name: "short row", csv: quoteHeader + "AAPL.US,2023-07-03,22:00:07\n", err: ErrMalformedQuote},
+		{name: "missing symbol", csv: quoteHeader + ",2023-07-03,22:00:07,193.78,193.88,191.76,192.46,31458198\n", err: ErrMalformedQuote},
+		{name: "html", csv: "<html><body>Exceeded the daily hits limit</body></html>\n", err: ErrMalformedQuote},
+		{name: "bad price", csv: quoteHeader + "AAPL.US,2023-07-03,22:00:07,193.78,193.88,low,192.46,31458198\n", err: ErrInvalidField},
+		{name: "bad date", csv: quoteHeader + "AAPL.US,03/07/2023,22:00:07,193.78,193.88,191.76,192.46,31458198\n", err: ErrInvalidField},
+		{name: "bad volume", csv: quoteHeader + "AAPL.US,2023-07-03,22:00:07,193.78,193.88,191.76,192.46,many\n", err: ErrInvalidField},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			quotes, err := parseQuotes(strings.NewReader(tc.csv))
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("unexpected error: got %v want %v", err, tc.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(quotes) != 1 || quotes[0] != tc.expected {
+				t.Errorf("unexpected quotes: got %+v want %+v", quotes, tc.expected)
+			}
+		})
+	}
+}
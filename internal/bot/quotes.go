@@ -0,0 +1,160 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnknownSymbol is returned by providers that have no quote for a symbol
+	ErrUnknownSymbol = errors.New("unknown stock symbol")
+	// ErrRateLimited is returned by providers refusing to answer more requests for now
+	ErrRateLimited = errors.New("quote source rate limit exceeded")
+)
+
+// stooqHitsLimit is what stooq answers, with a 200 status, once a client
+// asked for too many quotes in a day
+var stooqHitsLimit = []byte("Exceeded the daily hits limit")
+
+// Quote is the latest price of a stock
+type Quote struct {
+	Symbol string
+	Time   time.Time // date and time of the quote, as given by the source
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64 // latest price
+	Volume int64   // 0 for indexes and currencies
+}
+
+// String formats the quote as posted in the chat
+func (q Quote) String() string {
+	return fmt.Sprintf("%s quote is $%.2f per share", q.Symbol, q.Close)
+}
+
+// QuoteProvider is a source of stock quotes
+type QuoteProvider interface {
+	Quote(ctx context.Context, symbol string) (Quote, error)
+}
+
+// StooqProvider fetches quotes from the stooq.com CSV API
+type StooqProvider struct {
+	URL    string // https://stooq.com/q/l/, or a mirror of it
+	Client *http.Client
+}
+
+// NewStooqProvider creates a provider querying url
+func NewStooqProvider(url string) *StooqProvider {
+	return &StooqProvider{URL: url, Client: http.DefaultClient}
+}
+
+func (p *StooqProvider) Quote(ctx context.Context, symbol string) (Quote, error) {
+	query := url.Values{"s": {symbol}, "f": {"sd2t2ohlcv"}, "h": {""}, "e": {"csv"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+"?"+query.Encode(), nil)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return Quote{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return Quote{}, fmt.Errorf("%w: stooq answered %s", ErrRateLimited, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Quote{}, fmt.Errorf("stooq answered %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Quote{}, err
+	}
+	if bytes.Contains(body, stooqHitsLimit) {
+		return Quote{}, fmt.Errorf("%w: %s", ErrRateLimited, stooqHitsLimit)
+	}
+
+	quotes, err := parseQuotes(bytes.NewReader(body))
+	if err != nil {
+		return Quote{}, err
+	}
+	return quotes[0], nil
+}
+
+// FixtureProvider answers quotes from a fixed set, for tests and offline use
+type FixtureProvider map[string]Quote
+
+// LoadFixture reads a FixtureProvider from a CSV file in the stooq format
+func LoadFixture(path string) (FixtureProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	quotes, err := parseQuotes(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading quote fixture %s: %w", path, err)
+	}
+
+	fixture := make(FixtureProvider, len(quotes))
+	for _, q := range quotes {
+		fixture[strings.ToUpper(q.Symbol)] = q
+	}
+	return fixture, nil
+}
+
+func (f FixtureProvider) Quote(ctx context.Context, symbol string) (Quote, error) {
+	q, ok := f[strings.ToUpper(symbol)]
+	if !ok {
+		return Quote{}, fmt.Errorf("%w: %s", ErrUnknownSymbol, symbol)
+	}
+	return q, nil
+}
+
+// FallbackProvider asks its providers in order until one answers, giving each
+// of them Timeout to do so
+type FallbackProvider struct {
+	Providers []QuoteProvider
+	Timeout   time.Duration // no limit besides the caller's context when zero
+}
+
+func (p *FallbackProvider) Quote(ctx context.Context, symbol string) (Quote, error) {
+	var errs []error
+	for _, provider := range p.Providers {
+		q, err := p.quote(ctx, provider, symbol)
+		if err == nil {
+			return q, nil
+		}
+		errs = append(errs, err)
+
+		// The other providers are not asked once the caller gave up
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(errs) == 0 {
+		return Quote{}, errors.New("no quote provider")
+	}
+	return Quote{}, errors.Join(errs...)
+}
+
+func (p *FallbackProvider) quote(ctx context.Context, provider QuoteProvider, symbol string) (Quote, error) {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	return provider.Quote(ctx, symbol)
+}
@@ -0,0 +1,197 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrerussowsky/chat-app/internal/config"
+)
+
+func TestQuote_String(t *testing.T) {
+	testCases := []struct {
+		close    float64
+		expected string
+	}{
+		{192.46, "AAPL.US quote is $192.46 per share"},
+		{192.4, "AAPL.US quote is $192.40 per share"},
+		{93, "AAPL.US quote is $93.00 per share"},
+	}
+
+	for _, tc := range testCases {
+		if got := (Quote{Symbol: "AAPL.US", Close: tc.close}).String(); got != tc.expected {
+			t.Errorf("unexpected message: got %q want %q", got, tc.expected)
+		}
+	}
+}
+
+func TestStooqProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch symbol := r.URL.Query().Get("s"); symbol {
+		case "AAPL.US":
+			w.Write([]byte("Symbol,Date,Time,Open,High,Low,Close,Volume\r\nAAPL.US,2023-07-03,22:00:07,193.78,193.88,191.76,192.46,31458198\r\n"))
+		case "XYZ.US":
+			w.Write([]byte("Symbol,Date,Time,Open,High,Low,Close,Volume\r\nXYZ.US,N/D,N/D,N/D,N/D,N/D,N/D,N/D\r\n"))
+		case "BUSY.US":
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		case "LIMIT.US":
+			w.Write([]byte("Exceeded the daily hits limit"))
+		default:
+			http.Error(w, "unexpected symbol "+symbol, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	provider := NewStooqProvider(server.URL)
+	q, err := provider.Quote(context.Background(), "AAPL.US")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Quote{
+		Symbol: "AAPL.US",
+		Time:   time.Date(2023, 7, 3, 22, 0, 7, 0, time.UTC),
+		Open:   193.78,
+		High:   193.88,
+		Low:    191.76,
+		Close:  192.46,
+		Volume: 31458198,
+	}
+	if q != expected {
+		t.Errorf("unexpected quote: got %+v want %+v", q, expected)
+	}
+	if got := q.String(); got != "AAPL.US quote is $192.46 per share" {
+		t.Errorf("unexpected message: %q", got)
+	}
+
+	if _, err := provider.Quote(context.Background(), "MSFT.US"); err == nil {
+		t.Error("expected an error for an unsuccessful answer")
+	}
+	if _, err := provider.Quote(context.Background(), "XYZ.US"); !errors.Is(err, ErrUnknownSymbol) {
+		t.Errorf("expected ErrUnknownSymbol, got %v", err)
+	}
+	for _, symbol := range []string{"BUSY.US", "LIMIT.US"} {
+		if _, err := provider.Quote(context.Background(), symbol); !errors.Is(err, ErrRateLimited) {
+			t.Errorf("expected ErrRateLimited for %s, got %v", symbol, err)
+		}
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	fixture, err := LoadFixture("testdata/quotes.csv")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	q, err := fixture.Quote(context.Background(), "msft.us")
+	if err != nil || q.Close != 337.99 {
+		t.Errorf("unexpected quote: %+v, %v", q, err)
+	}
+	if _, err := fixture.Quote(context.Background(), "XYZ.US"); !errors.Is(err, ErrUnknownSymbol) {
+		t.Errorf("expected ErrUnknownSymbol, got %v", err)
+	}
+
+	if _, err := LoadFixture("testdata/missing.csv"); err == nil {
+		t.Error("expected an error for a missing fixture")
+	}
+}
+
+// providerFunc is a QuoteProvider calling a function
+type providerFunc func(ctx context.Context, symbol string) (Quote, error)
+
+func (f providerFunc) Quote(ctx context.Context, symbol string) (Quote, error) {
+	return f(ctx, symbol)
+}
+
+func TestFallbackProvider(t *testing.T) {
+	slow := providerFunc(func(ctx context.Context, symbol string) (Quote, error) {
+		<-ctx.Done()
+		return Quote{}, ctx.Err()
+	})
+	fixture := FixtureProvider{"AAPL.US": {Symbol: "AAPL.US", Close: 192.46}}
+	provider := &FallbackProvider{Providers: []QuoteProvider{slow, fixture}, Timeout: 10 * time.Millisecond}
+
+	// A slow provider is given up for the next one
+	q, err := provider.Quote(context.Background(), "AAPL.US")
+	if err != nil || q.Close != 192.46 {
+		t.Errorf("unexpected quote: %+v, %v", q, err)
+	}
+
+	// Every error is reported when no provider answers
+	_, err = provider.Quote(context.Background(), "XYZ.US")
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrUnknownSymbol) {
+		t.Errorf("expected both errors, got %v", err)
+	}
+
+	// The next providers are not asked once the caller gave up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := provider.Quote(ctx, "AAPL.US"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCachedProvider(t *testing.T) {
+	calls := 0
+	failing := false
+	provider := NewCachedProvider(providerFunc(func(ctx context.Context, symbol string) (Quote, error) {
+		calls++
+		if failing {
+			return Quote{}, errors.New("stooq is down")
+		}
+		return Quote{Symbol: symbol, Close: 192.46}, nil
+	}), time.Minute)
+	now := time.Date(2023, 7, 3, 22, 0, 0, 0, time.UTC)
+	provider.now = func() time.Time { return now }
+
+	testCases := []struct {
+		name          string
+		symbol        string
+		advance       time.Duration
+		failing       bool
+		expectedCalls int
+		expectedErr   bool
+	}{
+		{"first request", "AAPL.US", 0, false, 1, false},
+		{"cached", "AAPL.US", 30 * time.Second, false, 1, false},
+		{"keyed by symbol", "aapl.us", 0, false, 1, false},
+		{"other symbol", "MSFT.US", 0, false, 2, false},
+		{"expired", "AAPL.US", time.Minute, false, 3, false},
+		{"errors are not cached", "GOOGL.US", 0, true, 4, true},
+		{"retried after an error", "GOOGL.US", 0, true, 5, true},
+	}
+
+	for _, tc := range testCases {
+		now = now.Add(tc.advance)
+		failing = tc.failing
+
+		_, err := provider.Quote(context.Background(), tc.symbol)
+		if (err != nil) != tc.expectedErr {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if calls != tc.expectedCalls {
+			t.Errorf("%s: got %d calls want %d", tc.name, calls, tc.expectedCalls)
+		}
+	}
+}
+
+func TestNewQuoteProvider(t *testing.T) {
+	cfg := config.Default().Bot
+	cfg.QuoteProviders = "fixture, stooq"
+	cfg.QuoteFixture = "testdata/quotes.csv"
+
+	provider, err := NewQuoteProvider(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if q, err := provider.Quote(context.Background(), "GOOGL.US"); err != nil || q.Close != 119.9 {
+		t.Errorf("unexpected quote: %+v, %v", q, err)
+	}
+
+	cfg.QuoteFixture = "testdata/missing.csv"
+	if _, err := NewQuoteProvider(cfg); err == nil {
+		t.Error("expected an error for a missing fixture")
+	}
+}
@@ -0,0 +1,139 @@
+// Package broker carries the messages exchanged by the chat server and the stock bots.
+//
+// Broker is implemented over RabbitMQ by the rabbitmq package, and in process by
+// Memory so that the server, the bot and the tests can run without RabbitMQ.
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+var (
+	ErrNotConnected = errors.New("not connected to the message broker")
+	ErrUnknownQueue = errors.New("unknown queue")
+
+	// ErrPoison marks deliveries that can never be handled, handlers wrap it
+	// to send a delivery straight to the dead-letter queue
+	ErrPoison = errors.New("poison message")
+)
+
+// State is the state of the connection to the broker
+type State int32
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "closed"
+	}
+}
+
+// Queue is a queue messages are published on
+type Queue struct {
+	Name       string
+	Durable    bool   // survives broker restarts, along with its messages
+	DeadLetter string // durable queue receiving the rejected messages, if any
+}
+
+// Message is a message published on a queue
+type Message struct {
+	ContentType   string
+	CorrelationID string
+	ReplyTo       string // queue the answer to the message is expected on
+	Body          []byte
+}
+
+// Acknowledger settles a delivery with the broker it came from
+type Acknowledger interface {
+	Ack() error
+	// Nack rejects the delivery to the dead-letter queue, or puts it back on
+	// its queue with one more failed attempt recorded
+	Nack(requeue bool) error
+}
+
+// Delivery is a message received from a queue
+type Delivery struct {
+	Message
+	Queue        string
+	Attempts     int // failed attempts at handling the message before this one
+	Acknowledger Acknowledger
+}
+
+// Handler handles a delivery, the error it returns decides how Ack settles it
+type Handler func(Delivery) error
+
+// Broker publishes messages on queues and delivers them to their subscribers.
+// Every message of a queue is handled by one subscriber, while topics fan out
+// every message to all their subscribers, in any process.
+//
+// Queues and subscriptions are registered before calling Run, which connects
+// and keeps them in place until its context is done.
+type Broker interface {
+	// Declare declares queue, and its dead-letter queue if it has one
+	Declare(queue Queue)
+
+	// Publish publishes msg on the named queue, it returns once the broker has it
+	Publish(queue string, msg Message) error
+
+	// Subscribe hands every delivery of queue to handle, one at a time and in
+	// order, then settles it with Ack. Subscribers of the same queue share
+	// its deliveries.
+	Subscribe(queue string, handle Handler)
+
+	// PublishTopic publishes msg to every current subscriber of topic, it is
+	// dropped when there are none
+	PublishTopic(topic string, msg Message) error
+
+	// SubscribeTopic hands every message published on topic from now on to
+	// handle, like Subscribe. The messages published before the subscriber
+	// connected, or while it is disconnected, are not delivered to it.
+	SubscribeTopic(topic string, handle Handler)
+
+	// Ack settles d according to the error its handler returned: it is
+	// acknowledged on success, requeued after its first failure and rejected
+	// to the dead-letter queue after the second one. Errors wrapping ErrPoison
+	// are rejected right away, errors wrapping context.Canceled, from handlers
+	// interrupted by a shutdown, are always requeued.
+	Ack(d Delivery, err error)
+
+	// Run connects to the broker until ctx is done. When it returns the
+	// subscribers have handled their last delivery.
+	Run(ctx context.Context)
+
+	// State returns the current state of the connection
+	State() State
+
+	// Err returns the error that broke the last connection, if any
+	Err() error
+}
+
+// Settle implements the settlement policy of Broker.Ack over d's Acknowledger
+func Settle(d Delivery, err error) {
+	if err == nil {
+		d.Acknowledger.Ack()
+		return
+	}
+
+	// Give a failed delivery one more chance, it may have hit a transient problem
+	requeue := !errors.Is(err, ErrPoison) && (d.Attempts == 0 || errors.Is(err, context.Canceled))
+	if requeue {
+		log.Printf("Failed to handle message from %s, requeueing it: %v", d.Queue, err)
+	} else {
+		log.Printf("Failed to handle message from %s, rejecting it: %v", d.Queue, err)
+	}
+	d.Acknowledger.Nack(requeue)
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// acknowledger records how a delivery was settled
+type acknowledger struct {
+	acked    bool
+	nacked   bool
+	requeued bool
+}
+
+func (a *acknowledger) Ack() error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledger) Nack(requeue bool) error {
+	a.nacked = true
+	a.requeued = requeue
+	return nil
+}
+
+func TestSettle(t *testing.T) {
+	failure := errors.New("hub is shutting down")
+
+	testCases := []struct {
+		name     string
+		err      error
+		attempts int
+		expected acknowledger
+	}{
+		{"handled", nil, 0, acknowledger{acked: true}},
+		{"first failure is requeued", failure, 0, acknowledger{nacked: true, requeued: true}},
+		{"second failure is dead-lettered", failure, 1, acknowledger{nacked: true}},
+		{"interrupted is requeued", fmt.Errorf("getting the quote: %w", context.Canceled), 1, acknowledger{nacked: true, requeued: true}},
+		{"poison is dead-lettered", fmt.Errorf("%w: empty quote", ErrPoison), 0, acknowledger{nacked: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ack := &acknowledger{}
+			Settle(Delivery{Queue: "stock_quotes", Attempts: tc.attempts, Acknowledger: ack}, tc.err)
+
+			if *ack != tc.expected {
+				t.Errorf("unexpected settlement: got %+v want %+v", *ack, tc.expected)
+			}
+		})
+	}
+}
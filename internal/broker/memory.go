@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// Memory is a Broker keeping its queues in process, for running the chat
+// server and the bot in one process and for tests. Its messages do not survive
+// the process, whether their queue is durable or not.
+type Memory struct {
+	state atomic.Int32
+
+	mu            sync.Mutex
+	queues        map[string]*memoryQueue
+	topics        map[string][]*memoryQueue // the queue of every subscriber of a topic
+	subscriptions []subscription
+}
+
+// subscription is a handler subscribed to a queue
+type subscription struct {
+	queue  string
+	q      *memoryQueue // set for the own queue of a topic subscriber
+	handle Handler
+}
+
+var _ Broker = (*Memory)(nil)
+
+// NewMemory creates an in-process broker, it delivers messages once Run is called
+func NewMemory() *Memory {
+	return &Memory{queues: make(map[string]*memoryQueue), topics: make(map[string][]*memoryQueue)}
+}
+
+func (m *Memory) Declare(queue Queue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if queue.DeadLetter != "" && m.queues[queue.DeadLetter] == nil {
+		m.queues[queue.DeadLetter] = newMemoryQueue(Queue{Name: queue.DeadLetter, Durable: true})
+	}
+	if m.queues[queue.Name] == nil {
+		m.queues[queue.Name] = newMemoryQueue(queue)
+	}
+}
+
+// Publish queues msg, it fails for queues that were never declared
+func (m *Memory) Publish(queue string, msg Message) error {
+	if m.State() == StateClosed {
+		return ErrNotConnected
+	}
+
+	q, err := m.queue(queue)
+	if err != nil {
+		return err
+	}
+
+	q.push(Delivery{Message: msg, Queue: queue})
+	return nil
+}
+
+func (m *Memory) Subscribe(queue string, handle Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.subscriptions = append(m.subscriptions, subscription{queue: queue, handle: handle})
+}
+
+func (m *Memory) PublishTopic(topic string, msg Message) error {
+	if m.State() == StateClosed {
+		return ErrNotConnected
+	}
+
+	m.mu.Lock()
+	subscribers := m.topics[topic]
+	m.mu.Unlock()
+
+	for _, q := range subscribers {
+		q.push(Delivery{Message: msg, Queue: topic})
+	}
+	return nil
+}
+
+func (m *Memory) SubscribeTopic(topic string, handle Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := newMemoryQueue(Queue{Name: topic})
+	m.topics[topic] = append(m.topics[topic], q)
+	m.subscriptions = append(m.subscriptions, subscription{queue: topic, q: q, handle: handle})
+}
+
+func (m *Memory) Ack(d Delivery, err error) {
+	Settle(d, err)
+}
+
+// Run delivers the queued messages to the subscribers until ctx is done. The
+// messages still queued then are dropped with the broker.
+func (m *Memory) Run(ctx context.Context) {
+	defer m.state.Store(int32(StateClosed))
+
+	m.mu.Lock()
+	subscriptions := append([]subscription(nil), m.subscriptions...)
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, sub := range subscriptions {
+		q := sub.q
+		if q == nil {
+			var err error
+			if q, err = m.queue(sub.queue); err != nil {
+				log.Printf("Cannot subscribe to %s: %v", sub.queue, err)
+				continue
+			}
+		}
+
+		wg.Add(1)
+		go func(sub subscription) {
+			defer wg.Done()
+			m.consume(ctx, q, sub.handle)
+		}(sub)
+	}
+
+	m.state.Store(int32(StateConnected))
+	<-ctx.Done()
+}
+
+func (m *Memory) State() State {
+	return State(m.state.Load())
+}
+
+// Err always returns nil, the in-process broker cannot be disconnected
+func (m *Memory) Err() error {
+	return nil
+}
+
+// consume hands the deliveries of q to handle until ctx is done. It stops
+// before popping the next delivery once ctx is done, so a delivery requeued
+// because its handler was cancelled is not handled again.
+func (m *Memory) consume(ctx context.Context, q *memoryQueue, handle Handler) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		d, ok := q.pop()
+		if !ok {
+			select {
+			case <-q.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		d.Acknowledger = &memoryAcknowledger{broker: m, queue: q, delivery: d}
+		m.Ack(d, handle(d))
+	}
+}
+
+func (m *Memory) queue(name string) (*memoryQueue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.queues[name]
+	if q == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownQueue, name)
+	}
+	return q, nil
+}
+
+// memoryQueue holds the messages of a queue waiting for a subscriber
+type memoryQueue struct {
+	config Queue
+	ready  chan struct{} // signalled whenever a delivery is pushed
+
+	mu      sync.Mutex
+	pending []Delivery
+}
+
+func newMemoryQueue(config Queue) *memoryQueue {
+	return &memoryQueue{config: config, ready: make(chan struct{}, 1)}
+}
+
+func (q *memoryQueue) push(d Delivery) {
+	q.mu.Lock()
+	q.pending = append(q.pending, d)
+	q.mu.Unlock()
+
+	// The subscriber woken up keeps popping until the queue is empty, one
+	// pending signal is enough
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memoryQueue) pop() (Delivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return Delivery{}, false
+	}
+	d := q.pending[0]
+	q.pending[0] = Delivery{}
+	q.pending = q.pending[1:]
+	return d, true
+}
+
+// memoryAcknowledger settles a delivery of a Memory broker
+type memoryAcknowledger struct {
+	broker   *Memory
+	queue    *memoryQueue
+	delivery Delivery
+}
+
+func (a *memoryAcknowledger) Ack() error {
+	return nil
+}
+
+// Nack puts the delivery back on its queue, or moves it to the dead-letter
+// queue. Without a dead-letter queue the delivery is dropped.
+func (a *memoryAcknowledger) Nack(requeue bool) error {
+	d := a.delivery
+	d.Acknowledger = nil
+
+	if requeue {
+		d.Attempts++
+		a.queue.push(d)
+		return nil
+	}
+
+	if a.queue.config.DeadLetter == "" {
+		return nil
+	}
+	deadLetter, err := a.broker.queue(a.queue.config.DeadLetter)
+	if err != nil {
+		return err
+	}
+	d.Queue = deadLetter.config.Name
+	d.Attempts = 0
+	deadLetter.push(d)
+	return nil
+}
@@ -0,0 +1,248 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testQueue = Queue{Name: "stock_quotes", Durable: true, DeadLetter: "stock_quotes.dead"}
+
+// runMemory runs m until the test ends
+func runMemory(t *testing.T, m *Memory) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for m.State() != StateConnected {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the broker to start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// receive returns the next delivery sent on deliveries
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a delivery")
+		return Delivery{}
+	}
+}
+
+func TestMemory_PublishSubscribe(t *testing.T) {
+	m := NewMemory()
+	m.Declare(testQueue)
+
+	// Messages published before Run wait for the subscribers
+	if err := m.Publish(testQueue.Name, Message{CorrelationID: "1", Body: []byte("first")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deliveries := make(chan Delivery, 10)
+	m.Subscribe(testQueue.Name, func(d Delivery) error {
+		deliveries <- d
+		return nil
+	})
+	runMemory(t, m)
+
+	if err := m.Publish(testQueue.Name, Message{CorrelationID: "2", Body: []byte("second")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{"first", "second"} {
+		d := receive(t, deliveries)
+		if string(d.Body) != expected || d.Queue != testQueue.Name || d.Attempts != 0 {
+			t.Errorf("unexpected delivery: got %+v want %q", d, expected)
+		}
+	}
+}
+
+func TestMemory_UnknownQueue(t *testing.T) {
+	m := NewMemory()
+
+	if err := m.Publish("stock_quotes", Message{}); !errors.Is(err, ErrUnknownQueue) {
+		t.Errorf("expected ErrUnknownQueue, got %v", err)
+	}
+}
+
+func TestMemory_DeadLetters(t *testing.T) {
+	m := NewMemory()
+	m.Declare(testQueue)
+
+	attempts := make(chan Delivery, 10)
+	m.Subscribe(testQueue.Name, func(d Delivery) error {
+		attempts <- d
+		if string(d.Body) == "poison" {
+			return fmt.Errorf("%w: unreadable quote", ErrPoison)
+		}
+		return errors.New("hub is shutting down")
+	})
+	dead := make(chan Delivery, 10)
+	m.Subscribe(testQueue.DeadLetter, func(d Delivery) error {
+		dead <- d
+		return nil
+	})
+	runMemory(t, m)
+
+	// A failing message is retried once before being dead-lettered
+	m.Publish(testQueue.Name, Message{Body: []byte("failing")})
+	if d := receive(t, attempts); d.Attempts != 0 {
+		t.Errorf("expected a first delivery, got %+v", d)
+	}
+	if d := receive(t, attempts); d.Attempts != 1 {
+		t.Errorf("expected a second attempt, got %+v", d)
+	}
+	if d := receive(t, dead); string(d.Body) != "failing" || d.Queue != testQueue.DeadLetter || d.Attempts != 0 {
+		t.Errorf("unexpected dead letter: %+v", d)
+	}
+
+	// Poison is dead-lettered right away
+	m.Publish(testQueue.Name, Message{Body: []byte("poison")})
+	receive(t, attempts)
+	if d := receive(t, dead); string(d.Body) != "poison" {
+		t.Errorf("unexpected dead letter: %+v", d)
+	}
+	select {
+	case d := <-attempts:
+		t.Errorf("expected poison not to be redelivered, got %+v", d)
+	default:
+	}
+}
+
+func TestMemory_Run(t *testing.T) {
+	m := NewMemory()
+	m.Declare(testQueue)
+
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	handled := make(chan struct{})
+	m.Subscribe(testQueue.Name, func(d Delivery) error {
+		close(handling)
+		<-release
+		close(handled)
+		return nil
+	})
+
+	if state := m.State(); state != StateConnecting {
+		t.Errorf("unexpected state before Run: got %v want %v", state, StateConnecting)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+
+	m.Publish(testQueue.Name, Message{})
+	<-handling
+	cancel()
+
+	// Run waits for the delivery being handled
+	select {
+	case <-done:
+		t.Fatal("expected Run to wait for the handler")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return")
+	}
+	<-handled
+
+	if state := m.State(); state != StateClosed {
+		t.Errorf("unexpected state after Run: got %v want %v", state, StateClosed)
+	}
+	if err := m.Publish(testQueue.Name, Message{}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected after Run, got %v", err)
+	}
+}
+
+func TestMemory_RunCancelledHandler(t *testing.T) {
+	m := NewMemory()
+	m.Declare(testQueue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int32
+	m.Subscribe(testQueue.Name, func(d Delivery) error {
+		calls.Add(1)
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	m.Publish(testQueue.Name, Message{})
+
+	// The delivery is requeued for the next run instead of being handled again
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the cancelled delivery to be handled once, got %d calls", n)
+	}
+}
+
+func TestMemory_Topic(t *testing.T) {
+	m := NewMemory()
+
+	// Without subscribers the message is dropped
+	if err := m.PublishTopic("chat_messages", Message{Body: []byte("nobody")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	first := make(chan Delivery, 10)
+	second := make(chan Delivery, 10)
+	m.SubscribeTopic("chat_messages", func(d Delivery) error {
+		first <- d
+		return nil
+	})
+	m.SubscribeTopic("chat_messages", func(d Delivery) error {
+		second <- d
+		return nil
+	})
+	runMemory(t, m)
+
+	if err := m.PublishTopic("chat_messages", Message{Body: []byte("hi")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every subscriber gets its own copy
+	for _, deliveries := range []chan Delivery{first, second} {
+		if d := receive(t, deliveries); string(d.Body) != "hi" || d.Queue != "chat_messages" {
+			t.Errorf("unexpected delivery: %+v", d)
+		}
+	}
+	select {
+	case d := <-first:
+		t.Errorf("unexpected delivery: %+v", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,304 @@
+package chat
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+)
+
+// closeGracePeriod is how long a close frame may take to be written
+const closeGracePeriod = time.Second
+
+var (
+	ErrClientClosed = errors.New("client connection is closed")
+	ErrSlowConsumer = errors.New("client is too slow to keep up with its messages")
+)
+
+// Eviction metrics, published on /debug/vars by the default HTTP server
+var (
+	slowConsumerEvictions = expvar.NewInt("chat_slow_consumer_evictions")
+	droppedFrames         = expvar.NewInt("chat_dropped_frames")
+)
+
+// OverflowPolicy decides what happens when a client's send queue is full
+type OverflowPolicy string
+
+const (
+	// DisconnectSlowConsumer closes the connection of a client that cannot keep up
+	DisconnectSlowConsumer OverflowPolicy = "disconnect"
+	// DropOldest discards the oldest queued frame to make room for the new one
+	DropOldest OverflowPolicy = "drop_oldest"
+)
+
+// ClientConfig tunes client connections
+type ClientConfig struct {
+	SendQueueSize  int            // frames waiting to be written before the policy applies
+	WriteTimeout   time.Duration  // deadline for writing a single frame
+	OverflowPolicy OverflowPolicy // what to do when the send queue is full
+	PingInterval   time.Duration  // how often the peer is pinged
+	PongTimeout    time.Duration  // how long the peer may stay silent before it is considered dead
+	MaxMessageSize int64          // largest frame accepted from the peer, in bytes
+}
+
+// DefaultClientConfig returns the settings used when nothing else is configured
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		SendQueueSize:  256,
+		WriteTimeout:   10 * time.Second,
+		OverflowPolicy: DisconnectSlowConsumer,
+		PingInterval:   30 * time.Second,
+		PongTimeout:    60 * time.Second,
+		MaxMessageSize: 64 * 1024,
+	}
+}
+
+// frame is an outbound frame, either an envelope or a close frame
+type frame struct {
+	envelope    protocol.Envelope
+	close       bool
+	closeCode   int
+	closeReason string
+}
+
+// Client is a WebSocket connection of an authenticated chat user.
+//
+// Frames are queued and written by the client's own write pump, so a slow
+// connection never blocks the room broadcasting to it.
+type Client struct {
+	conn     *websocket.Conn
+	username string
+	config   ClientConfig
+
+	mu       sync.Mutex // serializes queueing with closing, guards nickname
+	nickname string     // display name chosen with /nick, empty for the username
+	queue    chan frame
+	closing  bool          // a close frame is queued, nothing else may follow it
+	done     chan struct{} // closed once the client is shutting down
+	closed   frame         // close frame the write pump sends when done is closed
+}
+
+// NewClient wraps a WebSocket connection authenticated as username and starts its write pump.
+//
+// Reads from the connection fail once the peer sends a frame larger than the
+// configured maximum, or stays silent, not even answering pings, for longer
+// than the pong timeout.
+func NewClient(conn *websocket.Conn, username string, config ClientConfig) *Client {
+	c := newClient(conn, username, config)
+
+	conn.SetReadLimit(c.config.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	})
+
+	go c.writePump()
+	return c
+}
+
+func newClient(conn *websocket.Conn, username string, config ClientConfig) *Client {
+	defaults := DefaultClientConfig()
+	if config.SendQueueSize <= 0 {
+		config.SendQueueSize = defaults.SendQueueSize
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = defaults.WriteTimeout
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = defaults.PingInterval
+	}
+	if config.PongTimeout <= config.PingInterval {
+		// The peer needs at least one ping to prove it is alive
+		config.PongTimeout = 2 * config.PingInterval
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = defaults.MaxMessageSize
+	}
+
+	return &Client{
+		conn:     conn,
+		username: username,
+		config:   config,
+		queue:    make(chan frame, config.SendQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// Username returns the user the connection was authenticated as
+func (c *Client) Username() string {
+	return c.username
+}
+
+// Nickname returns the display name chosen for the connection, empty when none was chosen
+func (c *Client) Nickname() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nickname
+}
+
+// SetNickname sets the display name of the connection, empty restores the username
+func (c *Client) SetNickname(nickname string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nickname = nickname
+}
+
+// ReadFrame reads the next data frame of the peer. Any frame proves the peer is
+// alive and extends the read deadline, like the pongs do.
+func (c *Client) ReadFrame() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	return data, nil
+}
+
+// Send queues an envelope for the client, applying the overflow policy when its queue is full
+func (c *Client) Send(envelope protocol.Envelope) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing || c.isDone() {
+		return ErrClientClosed
+	}
+
+	select {
+	case c.queue <- frame{envelope: envelope}:
+		return nil
+	default:
+	}
+
+	if c.config.OverflowPolicy == DropOldest {
+		select {
+		case <-c.queue:
+		default: // the write pump just made room
+		}
+		droppedFrames.Add(1)
+		c.queue <- frame{envelope: envelope}
+		return nil
+	}
+
+	slowConsumerEvictions.Add(1)
+	c.shutdown(frame{close: true, closeCode: websocket.CloseTryAgainLater, closeReason: "too slow to keep up"})
+	return ErrSlowConsumer
+}
+
+// SendEvent queues an event of eventType carrying data for the client
+func (c *Client) SendEvent(eventType string, data interface{}) error {
+	envelope, err := protocol.NewEnvelope(eventType, data)
+	if err != nil {
+		return err
+	}
+
+	return c.Send(envelope)
+}
+
+// SendError queues an error event answering the client frame with the given ID
+func (c *Client) SendError(id, code, message string) error {
+	envelope, err := protocol.NewEnvelope(protocol.TypeError, protocol.ErrorEvent{Code: code, Message: message})
+	if err != nil {
+		return err
+	}
+	envelope.ID = id
+
+	return c.Send(envelope)
+}
+
+// CloseWithReason sends a close frame with the given code and reason once the
+// frames already queued are written, then closes the connection
+func (c *Client) CloseWithReason(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing || c.isDone() {
+		return ErrClientClosed
+	}
+
+	c.closing = true
+	closing := frame{close: true, closeCode: code, closeReason: reason}
+	select {
+	case c.queue <- closing:
+	default:
+		// No room left to wait for, close right away
+		c.shutdown(closing)
+	}
+	return nil
+}
+
+// Close closes the connection, dropping the frames still queued
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.shutdown(frame{})
+	c.mu.Unlock()
+
+	return c.conn.Close()
+}
+
+// shutdown stops the client once, closing stores the close frame to send if any.
+// c.mu must be held.
+func (c *Client) shutdown(closing frame) {
+	if !c.isDone() {
+		c.closed = closing
+		close(c.done)
+	}
+}
+
+func (c *Client) isDone() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// writePump writes the queued frames and the pings to the connection until the
+// client is closed. Closing the connection makes the client's reader fail and
+// leave its room.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.config.WriteTimeout)); err != nil {
+				return
+			}
+
+		case f := <-c.queue:
+			if f.close {
+				c.writeClose(f)
+				return
+			}
+
+			c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+			if err := c.conn.WriteJSON(f.envelope); err != nil {
+				return
+			}
+
+		case <-c.done:
+			c.mu.Lock()
+			closing := c.closed
+			c.mu.Unlock()
+
+			if closing.close {
+				c.writeClose(closing)
+			}
+			return
+		}
+	}
+}
+
+func (c *Client) writeClose(f frame) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(f.closeCode, f.closeReason), time.Now().Add(closeGracePeriod))
+}
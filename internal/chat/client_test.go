@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+func TestClient_OverflowPolicy(t *testing.T) {
+	send := func(c *Client, id string) error {
+		return c.Send(protocol.Envelope{Type: protocol.TypeMessage, ID: id})
+	}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		// Without a write pump nothing leaves the queue
+		client := newClient(nil, "testuser", ClientConfig{SendQueueSize: 2, OverflowPolicy: DropOldest})
+		dropped := droppedFrames.Value()
+
+		for _, id := range []string{"1", "2", "3"} {
+			if err := send(client, id); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		if got := droppedFrames.Value() - dropped; got != 1 {
+			t.Errorf("unexpected dropped frames: got %d want 1", got)
+		}
+		for _, expected := range []string{"2", "3"} {
+			if f := <-client.queue; f.envelope.ID != expected {
+				t.Errorf("unexpected queued frame: got %q want %q", f.envelope.ID, expected)
+			}
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		client := newClient(nil, "testuser", ClientConfig{SendQueueSize: 2, OverflowPolicy: DisconnectSlowConsumer})
+		evictions := slowConsumerEvictions.Value()
+
+		send(client, "1")
+		send(client, "2")
+		if err := send(client, "3"); !errors.Is(err, ErrSlowConsumer) {
+			t.Errorf("expected ErrSlowConsumer, got %v", err)
+		}
+		if err := send(client, "4"); !errors.Is(err, ErrClientClosed) {
+			t.Errorf("expected ErrClientClosed, got %v", err)
+		}
+
+		if got := slowConsumerEvictions.Value() - evictions; got != 1 {
+			t.Errorf("unexpected evictions: got %d want 1", got)
+		}
+		if !client.isDone() || !client.closed.close {
+			t.Error("expected the client to be shut down with a close frame")
+		}
+	})
+}
+
+// TestRoom_SlowConsumer checks a peer that stops reading neither blocks the
+// room nor the other peers, and is evicted once its queue overflows
+func TestRoom_SlowConsumer(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	server := newRoomServer(t, room, ClientConfig{
+		SendQueueSize:  4,
+		WriteTimeout:   100 * time.Millisecond,
+		OverflowPolicy: DisconnectSlowConsumer,
+	})
+	evictions := slowConsumerEvictions.Value()
+
+	stalled := dialStalled(t, server, "stalled")
+	defer stalled.Close()
+	fast := dialStalled(t, server, "fast")
+	defer fast.Close()
+	waitFor(t, func() bool { return len(room.Members()) == 2 })
+
+	received := make(chan struct{})
+	go func() {
+		for {
+			var envelope protocol.Envelope
+			if err := fast.ReadJSON(&envelope); err != nil {
+				return
+			}
+			if envelope.Type == protocol.TypeMessage {
+				received <- struct{}{}
+			}
+		}
+	}()
+
+	// Large enough to fill the socket buffers of the stalled peer, the fast
+	// peer keeps getting every message in time
+	content := strings.Repeat("x", 64*1024)
+	for i := 0; i < 200; i++ {
+		room.Broadcast(models.Message{Username: "fast", Content: fmt.Sprintf("%d %s", i, content)})
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d was held up by the stalled peer", i)
+		}
+	}
+
+	waitFor(t, func() bool {
+		members := room.Members()
+		return len(members) == 1 && members[0] == "fast"
+	})
+	if slowConsumerEvictions.Value() == evictions {
+		t.Error("expected the stalled peer to be evicted")
+	}
+}
+
+// TestClient_Keepalive checks peers that stop answering pings are dropped
+// while peers that answer stay connected
+func TestClient_Keepalive(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	server := newRoomServer(t, room, ClientConfig{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  100 * time.Millisecond,
+	})
+
+	// Gorilla answers pings while reading, a peer that never reads never answers
+	silent := dialStalled(t, server, "silent")
+	defer silent.Close()
+	alive := dialRoomServer(t, server, "alive")
+	defer alive.Close()
+
+	waitFor(t, func() bool {
+		members := room.Members()
+		return len(members) == 1 && members[0] == "alive"
+	})
+
+	// Well past the pong timeout, the answering peer is still there
+	time.Sleep(300 * time.Millisecond)
+	if members := room.Members(); len(members) != 1 || members[0] != "alive" {
+		t.Errorf("unexpected members: %v", members)
+	}
+}
+
+func TestClient_MaxMessageSize(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	server := newRoomServer(t, room, ClientConfig{MaxMessageSize: 1024})
+
+	conn := dialStalled(t, server, "testuser")
+	defer conn.Close()
+	waitFor(t, func() bool { return len(room.Members()) == 1 })
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 512))); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 2048))); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	// The history and presence frames come first, then the close frame
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("expected close code %d, got %v", websocket.CloseMessageTooBig, err)
+			}
+			break
+		}
+	}
+	waitFor(t, func() bool { return len(room.Members()) == 0 })
+}
@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+// DefaultRoom is the room users land in when they do not pick one
+const DefaultRoom = "general"
+
+var (
+	ErrRoomExists      = errors.New("room already exists")
+	ErrRoomNotFound    = errors.New("room not found")
+	ErrRoomClosed      = errors.New("room is shutting down")
+	ErrInvalidRoomName = errors.New("room names must be 1-32 lowercase letters, digits, '-' or '_'")
+)
+
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Hub keeps track of the chat rooms
+type Hub struct {
+	messages storage.MessageStore
+
+	mu      sync.RWMutex
+	rooms   map[string]*Room
+	closing bool
+
+	relayMu sync.Mutex
+	outbox  chan RelayEvent // events for the other chat servers, nil until StartRelay
+	seen    recentIDs       // IDs of the last relay events handled
+}
+
+// NewHub creates a Hub storing its history in messages. It contains the
+// default room plus every room that already has stored history.
+func NewHub(messages storage.MessageStore) *Hub {
+	hub := &Hub{
+		messages: messages,
+		rooms:    make(map[string]*Room),
+		seen:     newRecentIDs(seenRelayEvents),
+	}
+	hub.CreateRoom(DefaultRoom)
+
+	rooms, err := messages.Rooms()
+	if err != nil {
+		log.Printf("Failed to restore rooms: %v", err)
+	}
+	for _, name := range rooms {
+		hub.CreateRoom(name)
+	}
+
+	return hub
+}
+
+// CreateRoom creates and starts a new room
+func (h *Hub) CreateRoom(name string) (*Room, error) {
+	room, err := h.createRoom(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h.relay(RelayEvent{Type: RelayRoomCreated, Room: name})
+	return room, nil
+}
+
+// createRoom creates and starts a new room without telling the other chat servers
+func (h *Hub) createRoom(name string) (*Room, error) {
+	if !roomNamePattern.MatchString(name) {
+		return nil, ErrInvalidRoomName
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closing {
+		return nil, ErrRoomClosed
+	}
+	if _, exists := h.rooms[name]; exists {
+		return nil, ErrRoomExists
+	}
+
+	room := newRoom(name, h.messages, h.relay)
+	h.rooms[name] = room
+	go room.run()
+
+	return room, nil
+}
+
+// Room returns the room with the given name, it fails once the hub is shutting down
+func (h *Hub) Room(name string) (*Room, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closing {
+		return nil, ErrRoomClosed
+	}
+
+	room, exists := h.rooms[name]
+	if !exists {
+		return nil, ErrRoomNotFound
+	}
+
+	return room, nil
+}
+
+// Rooms returns the names of all rooms in alphabetical order
+func (h *Hub) Rooms() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	names := make([]string, 0, len(h.rooms))
+	for name := range h.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Disconnect closes every connection of username, in all rooms, with the given error code and reason
+func (h *Hub) Disconnect(username, code, reason string) {
+	for _, room := range h.allRooms() {
+		room.Disconnect(username, code, reason)
+	}
+}
+
+// Shutdown closes every connection with reason once the events already
+// broadcast are written, and waits for the rooms to stop. When ctx is done
+// first the remaining connections are closed right away and ctx's error is
+// returned.
+func (h *Hub) Shutdown(ctx context.Context, reason string) error {
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
+
+	rooms := h.allRooms()
+	for _, room := range rooms {
+		room.shutdown(reason)
+	}
+
+	for _, room := range rooms {
+		select {
+		case <-room.stopped:
+		case <-ctx.Done():
+			for _, room := range rooms {
+				room.closeClients()
+			}
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (h *Hub) allRooms() []*Room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+func TestHub_CreateRoom(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+
+	if _, err := hub.CreateRoom("project-x"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := hub.CreateRoom("project-x"); !errors.Is(err, ErrRoomExists) {
+		t.Errorf("expected ErrRoomExists, got %v", err)
+	}
+	for _, name := range []string{"", "Upper", "with space", "a-name-that-is-way-too-long-for-a-room"} {
+		if _, err := hub.CreateRoom(name); !errors.Is(err, ErrInvalidRoomName) {
+			t.Errorf("expected ErrInvalidRoomName for %q, got %v", name, err)
+		}
+	}
+
+	if rooms := hub.Rooms(); len(rooms) != 2 || rooms[0] != DefaultRoom || rooms[1] != "project-x" {
+		t.Errorf("unexpected rooms: %v", rooms)
+	}
+	if _, err := hub.Room("missing"); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("expected ErrRoomNotFound, got %v", err)
+	}
+}
+
+func TestRoom_History(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.CreateRoom("project-x")
+	general, _ := hub.Room(DefaultRoom)
+
+	for i := 0; i < maxMessageCount+5; i++ {
+		room.Broadcast(models.Message{Content: fmt.Sprintf("message %d", i)})
+	}
+
+	last := fmt.Sprintf("message %d", maxMessageCount+4)
+	waitFor(t, func() bool {
+		history := room.History()
+		return len(history) > 0 && history[len(history)-1].Content == last
+	})
+
+	history := room.History()
+	if len(history) != maxMessageCount {
+		t.Errorf("unexpected history length: got %d, want %d", len(history), maxMessageCount)
+	}
+	if history[0].Content != "message 5" || history[0].Room != "project-x" {
+		t.Errorf("unexpected oldest message: %+v", history[0])
+	}
+	if len(general.History()) != 0 {
+		t.Errorf("unexpected messages in general history: %+v", general.History())
+	}
+}
+
+func TestHub_RestoresHistory(t *testing.T) {
+	messages := storage.NewMemoryMessageStore()
+	room, _ := NewHub(messages).CreateRoom("project-x")
+	room.Broadcast(models.Message{Username: "testuser", Content: "before restart"})
+
+	waitFor(t, func() bool {
+		page, _ := messages.MessagesBefore("project-x", 0, 1)
+		return len(page) == 1
+	})
+
+	// A new hub on the same store brings back the room and its history
+	restored, err := NewHub(messages).Room("project-x")
+	if err != nil {
+		t.Fatalf("expected room to be restored: %v", err)
+	}
+	history := restored.History()
+	if len(history) != 1 || history[0].Content != "before restart" || history[0].ID == 0 {
+		t.Errorf("unexpected restored history: %+v", history)
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHub_Shutdown(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	hub.CreateRoom("empty")
+	server := newRoomServer(t, room, DefaultClientConfig())
+
+	conn := dialStalled(t, server, "testuser")
+	defer conn.Close()
+	waitFor(t, func() bool { return len(room.Members()) == 1 })
+
+	for i := 0; i < 10; i++ {
+		room.Broadcast(models.Message{Username: "testuser", Content: fmt.Sprintf("message %d", i)})
+	}
+	if err := hub.Shutdown(context.Background(), "server shutting down"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every message broadcast before the shutdown arrives before the close frame
+	messages := 0
+	for {
+		var envelope protocol.Envelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) || !strings.Contains(err.Error(), "server shutting down") {
+				t.Errorf("unexpected close: %v", err)
+			}
+			break
+		}
+		if envelope.Type == protocol.TypeMessage {
+			messages++
+		}
+	}
+	if messages != 10 {
+		t.Errorf("unexpected messages before close: got %d want 10", messages)
+	}
+
+	if err := room.Join(newClient(nil, "late", DefaultClientConfig())); !errors.Is(err, ErrRoomClosed) {
+		t.Errorf("expected ErrRoomClosed, got %v", err)
+	}
+	if _, err := hub.CreateRoom("late"); !errors.Is(err, ErrRoomClosed) {
+		t.Errorf("expected ErrRoomClosed, got %v", err)
+	}
+}
+
+func TestHub_ShutdownTimeout(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	server := newRoomServer(t, room, DefaultClientConfig())
+
+	// A peer that never reads cannot receive its close frame before a full queue
+	stalled := dialStalled(t, server, "stalled")
+	defer stalled.Close()
+	waitFor(t, func() bool { return len(room.Members()) == 1 })
+
+	content := strings.Repeat("x", 64*1024)
+	for i := 0; i < 100; i++ {
+		room.Broadcast(models.Message{Content: content})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := hub.Shutdown(ctx, "server shutting down"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// The remaining connections were closed, so the room still stops
+	select {
+	case <-room.stopped:
+	case <-time.After(time.Second):
+		t.Error("expected the room to stop")
+	}
+}
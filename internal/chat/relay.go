@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+)
+
+// ErrInvalidRelayEvent is returned for relay events that can never be delivered
+var ErrInvalidRelayEvent = errors.New("invalid relay event")
+
+// droppedRelayEvents counts the events not relayed because the outbox was full
+var droppedRelayEvents = expvar.NewInt("chat_dropped_relay_events")
+
+const (
+	// relayQueueSize is how many events wait to be relayed before new ones are dropped
+	relayQueueSize = 1024
+
+	// seenRelayEvents is how many relay event keys a hub remembers to drop duplicates
+	seenRelayEvents = 10000
+)
+
+// Relay event types
+const (
+	RelayMessage       = "message"        // a message delivered to a room, or to a user with To
+	RelayCommandResult = "command_result" // the result of a command for the user To
+	RelayRoomCreated   = "room_created"   // a room was created
+)
+
+// RelayEvent is an event of a chat server that the other chat servers replay
+// to their own clients, so that users see the same rooms whichever server
+// they are connected to
+type RelayEvent struct {
+	ID      string                       `json:"id"` // unique, stored messages are told apart by their own ID
+	Type    string                       `json:"type"`
+	Room    string                       `json:"room"`
+	To      string                       `json:"to,omitempty"` // only for this user's connections, not in the history
+	Message *models.Message              `json:"message,omitempty"`
+	Result  *protocol.CommandResultEvent `json:"result,omitempty"` // of RelayCommandResult
+}
+
+// StartRelay returns the events to publish for the other chat servers. From
+// then on every message delivered by the rooms and every room created is
+// queued on it, events are dropped while it is full.
+func (h *Hub) StartRelay() <-chan RelayEvent {
+	h.relayMu.Lock()
+	defer h.relayMu.Unlock()
+
+	if h.outbox == nil {
+		h.outbox = make(chan RelayEvent, relayQueueSize)
+	}
+	return h.outbox
+}
+
+// relay queues e for the other chat servers once StartRelay was called
+func (h *Hub) relay(e RelayEvent) {
+	h.relayMu.Lock()
+	defer h.relayMu.Unlock()
+
+	if h.outbox == nil {
+		return
+	}
+
+	// Our own events come back from the other servers' point of view, remember
+	// them so they are not delivered twice
+	e.ID = newRelayID()
+	h.seen.add(e.key())
+
+	select {
+	case h.outbox <- e:
+	default:
+		droppedRelayEvents.Add(1)
+		log.Printf("Relay queue is full, dropping %s event of room %s", e.Type, e.Room)
+	}
+}
+
+// Relay delivers an event of another chat server to the local clients. Events
+// already handled, including the ones this hub relayed, are dropped.
+func (h *Hub) Relay(e RelayEvent) error {
+	if e.ID == "" {
+		return fmt.Errorf("%w: missing ID", ErrInvalidRelayEvent)
+	}
+	h.relayMu.Lock()
+	seen := h.seen.contains(e.key())
+	h.relayMu.Unlock()
+	if seen {
+		return nil
+	}
+
+	if err := h.replay(e); err != nil {
+		return err
+	}
+
+	// Only remember delivered events, a failed one may be delivered again
+	h.relayMu.Lock()
+	h.seen.add(e.key())
+	h.relayMu.Unlock()
+	return nil
+}
+
+// key identifies e to drop its duplicates. Stored messages have an ID shared
+// by all the chat servers using the database, which identifies them however
+// many times they are relayed; other events have their relay ID.
+func (e RelayEvent) key() string {
+	if e.Type == RelayMessage && e.Message != nil && e.Message.ID != 0 {
+		return "message:" + strconv.FormatInt(e.Message.ID, 10)
+	}
+	return e.ID
+}
+
+// replay delivers e to the local clients without relaying it again
+func (h *Hub) replay(e RelayEvent) error {
+	switch e.Type {
+	case RelayRoomCreated:
+		_, err := h.createRoom(e.Room)
+		if errors.Is(err, ErrRoomExists) {
+			return nil
+		}
+		return err
+
+	case RelayMessage:
+		if e.Message == nil {
+			return fmt.Errorf("%w: %s event without message", ErrInvalidRelayEvent, e.Type)
+		}
+
+		// The room may have been created before this server relayed events
+		room, err := h.Room(e.Room)
+		if errors.Is(err, ErrRoomNotFound) {
+			room, err = h.createRoom(e.Room)
+			if errors.Is(err, ErrRoomExists) {
+				room, err = h.Room(e.Room)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		message := *e.Message
+		message.Room = room.Name()
+		if e.To != "" {
+			room.sendTo(e.To, protocol.TypeMessage, message)
+		} else {
+			room.publish(event{eventType: protocol.TypeMessage, data: message, relayed: true})
+		}
+		return nil
+
+	case RelayCommandResult:
+		if e.Result == nil || e.To == "" {
+			return fmt.Errorf("%w: %s event without result or user", ErrInvalidRelayEvent, e.Type)
+		}
+
+		// Nobody to send the result to in a room this server does not have
+		room, err := h.Room(e.Room)
+		if errors.Is(err, ErrRoomNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		room.sendTo(e.To, protocol.TypeCommandResult, *e.Result)
+		return nil
+
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidRelayEvent, e.Type)
+	}
+}
+
+// recentIDs remembers the most recent IDs added to it
+type recentIDs struct {
+	ids  map[string]bool
+	ring []string // the IDs in the order they were added, next is the oldest
+	next int
+}
+
+func newRecentIDs(size int) recentIDs {
+	return recentIDs{ids: make(map[string]bool, size), ring: make([]string, size)}
+}
+
+func (r *recentIDs) contains(id string) bool {
+	return r.ids[id]
+}
+
+func (r *recentIDs) add(id string) {
+	if r.ids[id] {
+		return
+	}
+
+	if oldest := r.ring[r.next]; oldest != "" {
+		delete(r.ids, oldest)
+	}
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.ids[id] = true
+}
+
+func newRelayID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+// nextRelayEvent returns the next event queued on outbox
+func nextRelayEvent(t *testing.T, outbox <-chan RelayEvent) RelayEvent {
+	t.Helper()
+
+	select {
+	case e := <-outbox:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a relay event")
+		return RelayEvent{}
+	}
+}
+
+// nextMessage returns the content of the next message conn receives
+func nextMessage(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+
+	for {
+		var envelope protocol.Envelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if envelope.Type == protocol.TypeMessage {
+			var message models.Message
+			envelope.Decode(&message)
+			return message.Content
+		}
+	}
+}
+
+func TestHub_Relay(t *testing.T) {
+	// Two chat servers sharing their database
+	store := storage.NewMemoryMessageStore()
+	a, b := NewHub(store), NewHub(store)
+	outbox := a.StartRelay()
+	b.StartRelay()
+
+	projectA, err := a.CreateRoom("project-x")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	created := nextRelayEvent(t, outbox)
+	if created.Type != RelayRoomCreated || created.Room != "project-x" || created.ID == "" {
+		t.Errorf("unexpected event: %+v", created)
+	}
+	if err := b.Relay(created); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	projectB, err := b.Room("project-x")
+	if err != nil {
+		t.Fatalf("expected the room to be created on the other server: %v", err)
+	}
+
+	server := newRoomServer(t, projectB, DefaultClientConfig())
+	bob := dialStalled(t, server, "bob")
+	defer bob.Close()
+	waitFor(t, func() bool { return len(projectB.Members()) == 1 })
+
+	// Messages are stored once by the server they were sent to
+	projectA.Broadcast(models.Message{Username: "alice", Content: "hi"})
+	sent := nextRelayEvent(t, outbox)
+	if sent.Type != RelayMessage || sent.Message == nil || sent.Message.ID == 0 {
+		t.Errorf("unexpected event: %+v", sent)
+	}
+	// A message relayed again under another relay ID is still a duplicate
+	again := sent
+	again.ID = newRelayID()
+	for _, e := range []RelayEvent{sent, sent, again} {
+		if err := b.Relay(e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	projectB.Broadcast(models.Message{Username: "bob", Content: "hello"})
+
+	if got := nextMessage(t, bob); got != "hi" {
+		t.Errorf("unexpected first message: %q", got)
+	}
+	if got := nextMessage(t, bob); got != "hello" {
+		t.Errorf("expected the duplicate to be dropped, got %q", got)
+	}
+	if history := projectB.History(); len(history) != 2 || history[0].Content != "hi" {
+		t.Errorf("unexpected history: %+v", history)
+	}
+	if stored, _ := store.MessagesBefore("project-x", 0, 10); len(stored) != 2 {
+		t.Errorf("unexpected stored messages: %+v", stored)
+	}
+
+	// A server drops the events it relayed itself when they come back
+	if err := a.Relay(again); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if history := projectA.History(); len(history) != 1 {
+		t.Errorf("unexpected history after echo: %+v", history)
+	}
+
+	// Private messages reach the user on whichever server they are connected to
+	projectA.SendTo("bob", models.Message{Username: "Bot", Content: "only for bob"})
+	private := nextRelayEvent(t, outbox)
+	if private.To != "bob" {
+		t.Errorf("unexpected event: %+v", private)
+	}
+	if err := b.Relay(private); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := nextMessage(t, bob); got != "only for bob" {
+		t.Errorf("unexpected private message: %q", got)
+	}
+	if history := projectB.History(); len(history) != 2 {
+		t.Errorf("unexpected history after private message: %+v", history)
+	}
+
+	// So do the results of their commands
+	projectA.SendResultTo("bob", protocol.CommandResultEvent{Command: "/stock", Code: "timeout", Content: "Sorry"})
+	result := nextRelayEvent(t, outbox)
+	if result.Type != RelayCommandResult || result.To != "bob" || result.Result == nil {
+		t.Errorf("unexpected event: %+v", result)
+	}
+	if err := b.Relay(result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for {
+		var envelope protocol.Envelope
+		if err := bob.ReadJSON(&envelope); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if envelope.Type == protocol.TypeCommandResult {
+			var got protocol.CommandResultEvent
+			envelope.Decode(&got)
+			if got != *result.Result {
+				t.Errorf("unexpected result: got %+v want %+v", got, *result.Result)
+			}
+			break
+		}
+	}
+
+	// Messages of rooms created before relaying started create the room
+	if err := b.Relay(RelayEvent{ID: "1", Type: RelayMessage, Room: "older", Message: &models.Message{Content: "hi"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := b.Room("older"); err != nil {
+		t.Errorf("expected the room to be created: %v", err)
+	}
+}
+
+func TestHub_RelayInvalid(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+
+	testCases := []struct {
+		name  string
+		event RelayEvent
+	}{
+		{"missing ID", RelayEvent{Type: RelayRoomCreated, Room: "project-x"}},
+		{"missing message", RelayEvent{ID: "1", Type: RelayMessage, Room: DefaultRoom}},
+		{"missing result", RelayEvent{ID: "4", Type: RelayCommandResult, Room: DefaultRoom, To: "bob"}},
+		{"unknown type", RelayEvent{ID: "2", Type: "typing", Room: DefaultRoom}},
+	}
+	for _, tc := range testCases {
+		if err := hub.Relay(tc.event); !errors.Is(err, ErrInvalidRelayEvent) {
+			t.Errorf("%s: expected ErrInvalidRelayEvent, got %v", tc.name, err)
+		}
+	}
+
+	if err := hub.Relay(RelayEvent{ID: "3", Type: RelayRoomCreated, Room: "Not A Room"}); !errors.Is(err, ErrInvalidRoomName) {
+		t.Errorf("expected ErrInvalidRoomName, got %v", err)
+	}
+}
+
+func TestRecentIDs(t *testing.T) {
+	ids := newRecentIDs(2)
+	ids.add("a")
+	ids.add("b")
+	ids.add("b")
+	if !ids.contains("a") || !ids.contains("b") {
+		t.Errorf("expected a and b to be remembered: %+v", ids)
+	}
+
+	ids.add("c")
+	if ids.contains("a") || !ids.contains("b") || !ids.contains("c") {
+		t.Errorf("expected a to be forgotten: %+v", ids)
+	}
+}
@@ -0,0 +1,334 @@
+package chat
+
+import (
+	"log"
+	"sort"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+// maxMessageCount is the number of recent messages a room keeps in memory
+const maxMessageCount = 50
+
+// event is an event broadcast to every client of a room
+type event struct {
+	eventType string
+	data      interface{}
+	relayed   bool // a message of another chat server, which already stored it
+}
+
+// membership asks the room to add or remove a client, done receives the outcome
+type membership struct {
+	client *Client
+	done   chan error
+}
+
+// Room is a chat room with its own members, history and broadcast loop.
+//
+// The members and the recent history are owned by the goroutine running the
+// room, every other goroutine goes through the register, unregister,
+// broadcast and requests channels.
+type Room struct {
+	name  string
+	store storage.MessageStore
+	relay func(RelayEvent) // shares the room's messages with the other chat servers
+
+	register   chan membership
+	unregister chan membership
+	broadcast  chan event
+	requests   chan func()   // run by the owner goroutine, used to read its state
+	stopped    chan struct{} // closed once the room stopped running
+
+	// Only accessed by run
+	clients  map[*Client]bool
+	messages []models.Message // most recent messages, also persisted in store
+	closing  bool             // the room is shutting down and refuses new clients
+}
+
+func newRoom(name string, store storage.MessageStore, relay func(RelayEvent)) *Room {
+	messages, err := store.MessagesBefore(name, 0, maxMessageCount)
+	if err != nil {
+		log.Printf("Failed to load history of room %s: %v", name, err)
+	}
+
+	return &Room{
+		name:       name,
+		store:      store,
+		relay:      relay,
+		register:   make(chan membership),
+		unregister: make(chan membership),
+		broadcast:  make(chan event),
+		requests:   make(chan func()),
+		stopped:    make(chan struct{}),
+		clients:    make(map[*Client]bool),
+		messages:   messages,
+	}
+}
+
+// Name returns the name of the room
+func (r *Room) Name() string {
+	return r.name
+}
+
+// Join adds a client to the room, sends it the recent history and tells the room
+func (r *Room) Join(client *Client) error {
+	done := make(chan error, 1)
+	select {
+	case r.register <- membership{client: client, done: done}:
+		return <-done
+	case <-r.stopped:
+		return ErrRoomClosed
+	}
+}
+
+// Leave removes a client from the room and tells the room
+func (r *Room) Leave(client *Client) {
+	done := make(chan error, 1)
+	select {
+	case r.unregister <- membership{client: client, done: done}:
+		<-done
+	case <-r.stopped:
+	}
+}
+
+// Disconnect closes the connections of username with the given error code and reason
+func (r *Room) Disconnect(username, code, reason string) {
+	r.do(func() {
+		for client := range r.clients {
+			if client.Username() == username {
+				client.SendError("", code, reason)
+				// Closing makes the client's reader fail and leave the room
+				client.CloseWithReason(websocket.ClosePolicyViolation, reason)
+			}
+		}
+	})
+}
+
+// Members returns the usernames connected to the room in alphabetical order
+func (r *Room) Members() []string {
+	var members []string
+	r.do(func() {
+		members = r.members()
+	})
+	return members
+}
+
+// Member is a connection of a room, as listed by /who
+type Member struct {
+	Username string
+	Nickname string
+}
+
+// Who returns the username and nickname of every connection of the room,
+// ordered by username, connections with the same names are listed once
+func (r *Room) Who() []Member {
+	var members []Member
+	r.do(func() {
+		seen := make(map[Member]bool)
+		for client := range r.clients {
+			member := Member{Username: client.Username(), Nickname: client.Nickname()}
+			if !seen[member] {
+				seen[member] = true
+				members = append(members, member)
+			}
+		}
+	})
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Username != members[j].Username {
+			return members[i].Username < members[j].Username
+		}
+		return members[i].Nickname < members[j].Nickname
+	})
+
+	return members
+}
+
+// History returns a copy of the most recent messages of the room
+func (r *Room) History() []models.Message {
+	var history []models.Message
+	r.do(func() {
+		history = append([]models.Message(nil), r.messages...)
+	})
+	return history
+}
+
+// Broadcast sends a message to everyone in the room
+func (r *Room) Broadcast(message models.Message) {
+	message.Room = r.name
+	r.publish(event{eventType: protocol.TypeMessage, data: message})
+}
+
+// SendTo sends a message only to the connections of username in the room, it
+// is not recorded in the history
+func (r *Room) SendTo(username string, message models.Message) {
+	message.Room = r.name
+	r.sendTo(username, protocol.TypeMessage, message)
+	r.relay(RelayEvent{Type: RelayMessage, Room: r.name, To: username, Message: &message})
+}
+
+// SendResultTo sends the result of a command that completed later, such as
+// a stock quote that could not be given, to the connections of username in
+// the room
+func (r *Room) SendResultTo(username string, result protocol.CommandResultEvent) {
+	r.sendTo(username, protocol.TypeCommandResult, result)
+	r.relay(RelayEvent{Type: RelayCommandResult, Room: r.name, To: username, Result: &result})
+}
+
+// sendTo sends an event to the local connections of username
+func (r *Room) sendTo(username, eventType string, data interface{}) {
+	r.do(func() {
+		for client := range r.clients {
+			if client.Username() == username {
+				client.SendEvent(eventType, data)
+			}
+		}
+	})
+}
+
+// Typing tells everyone in the room that username started or stopped typing
+func (r *Room) Typing(username string, typing bool) {
+	r.publish(event{eventType: protocol.TypeTyping, data: protocol.TypingEvent{Room: r.name, Username: username, Typing: typing}})
+}
+
+// publish hands an event to the room, events published once the room stopped are dropped
+func (r *Room) publish(e event) {
+	select {
+	case r.broadcast <- e:
+	case <-r.stopped:
+	}
+}
+
+// do runs f on the goroutine owning the room state and waits for it, f is
+// not run once the room stopped
+func (r *Room) do(f func()) {
+	done := make(chan struct{})
+	request := func() {
+		f()
+		close(done)
+	}
+
+	select {
+	case r.requests <- request:
+		<-done
+	case <-r.stopped:
+	}
+}
+
+// shutdown refuses new clients and closes the connections of the room with
+// reason once the events already published are written. The room stops once
+// every client left, see stopped.
+func (r *Room) shutdown(reason string) {
+	r.do(func() {
+		r.closing = true
+		for client := range r.clients {
+			client.CloseWithReason(websocket.CloseGoingAway, reason)
+		}
+	})
+}
+
+// closeClients closes the connections of the room right away
+func (r *Room) closeClients() {
+	r.do(func() {
+		for client := range r.clients {
+			client.Close()
+		}
+	})
+}
+
+// run owns the room state, it records messages and broadcasts the events of the
+// room until the room is shut down and its last client left
+func (r *Room) run() {
+	defer close(r.stopped)
+
+	for !r.closing || len(r.clients) > 0 {
+		select {
+		case m := <-r.register:
+			if r.closing {
+				m.done <- ErrRoomClosed
+				continue
+			}
+
+			r.clients[m.client] = true
+			history := append([]models.Message{}, r.messages...)
+			m.done <- m.client.SendEvent(protocol.TypeHistory, protocol.HistoryEvent{Room: r.name, Messages: history})
+
+			r.deliver(event{eventType: protocol.TypeJoin, data: protocol.MemberEvent{Room: r.name, Username: m.client.Username()}})
+			r.deliverPresence()
+
+		case m := <-r.unregister:
+			if r.clients[m.client] {
+				delete(r.clients, m.client)
+				r.deliver(event{eventType: protocol.TypeLeave, data: protocol.MemberEvent{Room: r.name, Username: m.client.Username()}})
+				r.deliverPresence()
+			}
+			close(m.done)
+
+		case e := <-r.broadcast:
+			r.deliver(e)
+
+		case f := <-r.requests:
+			f()
+		}
+	}
+}
+
+// deliver stores messages and sends an event to every client of the room,
+// messages are relayed to the other chat servers
+func (r *Room) deliver(e event) {
+	if message, ok := e.data.(models.Message); ok && !e.relayed {
+		stored, err := r.store.AppendMessage(message)
+		if err != nil {
+			// Still deliver the message, it only misses from the durable history
+			log.Printf("Failed to store message in room %s: %v", r.name, err)
+		} else {
+			message = stored
+			e.data = stored
+		}
+		r.relay(RelayEvent{Type: RelayMessage, Room: r.name, Message: &message})
+	}
+
+	if message, ok := e.data.(models.Message); ok {
+		// When adding a new message:
+		if len(r.messages) >= maxMessageCount {
+			// Remove the oldest message
+			r.messages = r.messages[1:]
+		}
+
+		r.messages = append(r.messages, message)
+	}
+
+	envelope, err := protocol.NewEnvelope(e.eventType, e.data)
+	if err != nil {
+		log.Printf("Failed to encode %s event in room %s: %v", e.eventType, r.name, err)
+		return
+	}
+
+	// Broadcast only the new event, clients got the history when they joined.
+	// Sending only queues the event, clients that cannot keep up are handled by
+	// their overflow policy and leave the room once their connection closes.
+	for client := range r.clients {
+		client.Send(envelope)
+	}
+}
+
+func (r *Room) deliverPresence() {
+	r.deliver(event{eventType: protocol.TypePresence, data: protocol.PresenceEvent{Room: r.name, Members: r.members()}})
+}
+
+func (r *Room) members() []string {
+	seen := make(map[string]bool)
+	members := []string{}
+	for client := range r.clients {
+		if !seen[client.Username()] {
+			seen[client.Username()] = true
+			members = append(members, client.Username())
+		}
+	}
+	sort.Strings(members)
+
+	return members
+}
@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+// newRoomServer serves WebSockets joining room as the user given in the query
+func newRoomServer(t *testing.T, room *Room, config ClientConfig) *httptest.Server {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(conn, r.URL.Query().Get("username"), config)
+		defer client.Close()
+
+		defer room.Leave(client)
+		if err := room.Join(client); err != nil {
+			return
+		}
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// dialRoomServer connects to server as username and drains the frames it receives
+func dialRoomServer(t *testing.T, server *httptest.Server, username string) *websocket.Conn {
+	t.Helper()
+
+	conn := dialStalled(t, server, username)
+	if conn == nil {
+		return nil
+	}
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn
+}
+
+// dialStalled connects to server as username without ever reading
+func dialStalled(t *testing.T, server *httptest.Server, username string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?username=" + username
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Errorf("failed to dial: %v", err)
+		return nil
+	}
+	return conn
+}
+
+// TestRoom_Concurrency hammers a room with concurrent connects, disconnects and
+// broadcasts, run it with -race to check the room state is never shared
+func TestRoom_Concurrency(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	server := newRoomServer(t, room, DefaultClientConfig())
+
+	const users = 20
+	const messagesPerUser = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			username := fmt.Sprintf("user%d", i)
+			conn := dialRoomServer(t, server, username)
+			if conn == nil {
+				return
+			}
+			defer conn.Close()
+
+			for j := 0; j < messagesPerUser; j++ {
+				room.Broadcast(models.Message{Username: username, Content: fmt.Sprintf("message %d", j)})
+				room.Typing(username, j%2 == 0)
+				room.Members()
+				room.History()
+			}
+		}(i)
+	}
+
+	// Meanwhile other goroutines use the hub and broadcast to every room
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			hub.CreateRoom(fmt.Sprintf("room-%d", i))
+			for _, room := range hub.allRooms() {
+				room.Broadcast(models.Message{Username: "Bot", Content: "hello"})
+			}
+			hub.Rooms()
+			hub.Disconnect("nobody", "logged_out", "logged out")
+		}(i)
+	}
+	wg.Wait()
+
+	// Every connection eventually leaves, and every message was recorded
+	waitFor(t, func() bool { return len(room.Members()) == 0 })
+
+	if rooms := hub.Rooms(); len(rooms) != 6 {
+		t.Errorf("unexpected rooms: got %v", rooms)
+	}
+	if history := room.History(); len(history) != maxMessageCount {
+		t.Errorf("unexpected history length: got %d want %d", len(history), maxMessageCount)
+	}
+	page, _ := room.store.MessagesBefore(DefaultRoom, 0, users*messagesPerUser+5)
+	if len(page) != users*messagesPerUser+5 {
+		t.Errorf("unexpected stored messages: got %d want %d", len(page), users*messagesPerUser+5)
+	}
+}
+
+func TestRoom_JoinAndLeave(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	server := newRoomServer(t, room, DefaultClientConfig())
+
+	alice := dialRoomServer(t, server, "alice")
+	bob := dialRoomServer(t, server, "bob")
+	extra := dialRoomServer(t, server, "bob") // a second tab of bob
+
+	waitFor(t, func() bool { return len(room.Members()) == 2 })
+	if members := room.Members(); members[0] != "alice" || members[1] != "bob" {
+		t.Errorf("unexpected members: %v", members)
+	}
+
+	bob.Close()
+	alice.Close()
+	waitFor(t, func() bool {
+		members := room.Members()
+		return len(members) == 1 && members[0] == "bob"
+	})
+
+	hub.Disconnect("bob", "logged_out", "logged out")
+	waitFor(t, func() bool { return len(room.Members()) == 0 })
+	extra.Close()
+}
+
+func TestRoom_SendTo(t *testing.T) {
+	hub := NewHub(storage.NewMemoryMessageStore())
+	room, _ := hub.Room(DefaultRoom)
+	server := newRoomServer(t, room, DefaultClientConfig())
+
+	alice := dialStalled(t, server, "alice")
+	defer alice.Close()
+	bob := dialStalled(t, server, "bob")
+	defer bob.Close()
+	waitFor(t, func() bool { return len(room.Members()) == 2 })
+
+	room.SendTo("alice", models.Message{Username: "Bot", Content: "only for alice"})
+	room.Broadcast(models.Message{Username: "Bot", Content: "for everyone"})
+
+	// Messages arrive in order, so the first message each peer gets tells who got the private one
+	firstMessage := func(conn *websocket.Conn) string {
+		for {
+			var envelope protocol.Envelope
+			if err := conn.ReadJSON(&envelope); err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if envelope.Type == protocol.TypeMessage {
+				var message models.Message
+				envelope.Decode(&message)
+				return message.Content
+			}
+		}
+	}
+	if got := firstMessage(alice); got != "only for alice" {
+		t.Errorf("unexpected first message for alice: %q", got)
+	}
+	if got := firstMessage(bob); got != "for everyone" {
+		t.Errorf("unexpected first message for bob: %q", got)
+	}
+	if history := room.History(); len(history) != 1 || history[0].Content != "for everyone" {
+		t.Errorf("unexpected history: %+v", history)
+	}
+}
@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+)
+
+var nicknamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func init() {
+	Register(Command{
+		Name:    "help",
+		Usage:   "/help [command]",
+		Help:    "List the commands, or explain one of them",
+		MaxArgs: 1,
+		Run:     help,
+	})
+	Register(Command{
+		Name:    "me",
+		Usage:   "/me <action>",
+		Help:    "Tell the room what you are doing, e.g. /me waves",
+		MinArgs: 1,
+		MaxArgs: -1,
+		Run:     me,
+	})
+	Register(Command{
+		Name:    "nick",
+		Usage:   "/nick [nickname]",
+		Help:    "Choose the name shown next to your username on this connection, or drop it",
+		MaxArgs: 1,
+		Run:     nick,
+	})
+	Register(Command{
+		Name:    "who",
+		Usage:   "/who",
+		Help:    "List who is connected to the room",
+		MaxArgs: 0,
+		Run:     who,
+	})
+}
+
+func help(ctx *Context, args []string) (string, error) {
+	if len(args) == 1 {
+		name := strings.TrimPrefix(strings.ToLower(args[0]), "/")
+		cmd, ok := ctx.Registry.Lookup(name)
+		if !ok {
+			return "", Refuse("There is no /%s command. Type /help to list the commands.", name)
+		}
+		return fmt.Sprintf("%s: %s", cmd.Usage, cmd.Help), nil
+	}
+
+	lines := []string{"Available commands:"}
+	for _, cmd := range ctx.Registry.Commands() {
+		lines = append(lines, fmt.Sprintf("%s: %s", cmd.Usage, cmd.Help))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func me(ctx *Context, args []string) (string, error) {
+	name := ctx.Client.Username()
+	if nickname := ctx.Client.Nickname(); nickname != "" {
+		name = nickname
+	}
+
+	ctx.Room.Broadcast(models.Message{
+		Username:  ctx.Client.Username(),
+		Nickname:  ctx.Client.Nickname(),
+		Content:   fmt.Sprintf("* %s %s", name, ctx.Raw),
+		Timestamp: time.Now().Format(time.DateTime),
+	})
+	ctx.Ack()
+
+	return "", nil
+}
+
+func nick(ctx *Context, args []string) (string, error) {
+	if len(args) == 0 {
+		ctx.Client.SetNickname("")
+		return "Your nickname was removed.", nil
+	}
+
+	if !nicknamePattern.MatchString(args[0]) {
+		return "", Refuse("Nicknames must be 1-32 letters, digits, '-' or '_'.")
+	}
+	ctx.Client.SetNickname(args[0])
+
+	return fmt.Sprintf("You are now known as %s.", args[0]), nil
+}
+
+func who(ctx *Context, args []string) (string, error) {
+	var names []string
+	for _, member := range ctx.Room.Who() {
+		if member.Nickname != "" {
+			names = append(names, fmt.Sprintf("%s (%s)", member.Nickname, member.Username))
+		} else {
+			names = append(names, member.Username)
+		}
+	}
+
+	return fmt.Sprintf("Online in #%s: %s", ctx.Room.Name(), strings.Join(names, ", ")), nil
+}
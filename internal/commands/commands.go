@@ -0,0 +1,213 @@
+// Package commands runs the slash commands typed in the chat.
+//
+// Commands register themselves in a Registry, usually Default from an init
+// function, and the registry parses, checks and runs them and answers the
+// client. /help is generated from the registered commands.
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+)
+
+var (
+	ErrDuplicateCommand = errors.New("command already registered")
+	ErrInvalidName      = errors.New("command names must be 1-32 lowercase letters, digits, '-' or '_'")
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Context is the connection and room a command was typed in
+type Context struct {
+	Client   *chat.Client
+	Room     *chat.Room
+	FrameID  string    // ID of the client frame carrying the command
+	Raw      string    // arguments as typed, for commands taking free text
+	Registry *Registry // registry running the command
+}
+
+// Ack confirms the client frame carrying the command, for commands answering with events
+func (c *Context) Ack() {
+	if c.FrameID != "" {
+		c.Client.SendEvent(protocol.TypeAck, protocol.AckEvent{ID: c.FrameID})
+	}
+}
+
+// Refusal explains to the user why a command did not run
+type Refusal struct {
+	Reason string // shown in the chat as is
+}
+
+// Refuse returns a Refusal with the formatted reason
+func Refuse(format string, args ...interface{}) error {
+	return &Refusal{Reason: fmt.Sprintf(format, args...)}
+}
+
+func (r *Refusal) Error() string {
+	return "command refused: " + r.Reason
+}
+
+// Permission decides whether the command may run in ctx, a Refusal is shown
+// to the user
+type Permission func(ctx *Context) error
+
+// Command is a slash command
+type Command struct {
+	Name       string // typed after the slash
+	Usage      string // e.g. "/nick [name]"
+	Help       string // one line description shown by /help
+	MinArgs    int
+	MaxArgs    int        // negative for no limit
+	Permission Permission // nil lets anyone run the command
+
+	// Run runs the command with the space separated arguments. A non-empty
+	// reply is sent to the user, commands replying otherwise return "". The
+	// reason of a Refusal is shown to the user, other errors are logged.
+	Run func(ctx *Context, args []string) (reply string, err error)
+}
+
+// Registry holds the available commands
+type Registry struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]Command)}
+}
+
+// Default is the registry of the chat, commands register in it from init functions
+var Default = NewRegistry()
+
+// Register adds cmd to Default and panics if it cannot, which is a programming error
+func Register(cmd Command) {
+	if err := Default.Register(cmd); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds cmd to the registry
+func (r *Registry) Register(cmd Command) error {
+	if !namePattern.MatchString(cmd.Name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, cmd.Name)
+	}
+	if cmd.Usage == "" {
+		cmd.Usage = "/" + cmd.Name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.commands[cmd.Name]; exists {
+		return fmt.Errorf("%w: /%s", ErrDuplicateCommand, cmd.Name)
+	}
+	r.commands[cmd.Name] = cmd
+
+	return nil
+}
+
+// Lookup returns the command with the given name
+func (r *Registry) Lookup(name string) (Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// Commands returns every command in alphabetical order
+func (r *Registry) Commands() []Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	commands := make([]Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+
+	return commands
+}
+
+// Parse splits a slash command into its name and arguments. The arguments
+// follow a space, or an equal sign as in /stock=AAPL.US.
+func Parse(content string) (name, raw string) {
+	content = strings.TrimPrefix(strings.TrimSpace(content), "/")
+	if i := strings.IndexAny(content, " ="); i >= 0 {
+		return strings.ToLower(content[:i]), strings.TrimSpace(content[i+1:])
+	}
+	return strings.ToLower(content), ""
+}
+
+// Execute runs the slash command in content and answers the client with a
+// command_result event, unless the command answers on its own
+func (r *Registry) Execute(ctx *Context, content string) {
+	name, raw := Parse(content)
+	ctx.Raw = raw
+	ctx.Registry = r
+
+	cmd, ok := r.Lookup(name)
+	if !ok {
+		result(ctx, "/"+name, false, fmt.Sprintf("I'm sorry, I didn't understand /%s. Type /help to list the commands.", name))
+		return
+	}
+
+	if cmd.Permission != nil {
+		if err := cmd.Permission(ctx); err != nil {
+			fail(ctx, "/"+name, err)
+			return
+		}
+	}
+
+	args := strings.Fields(raw)
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		result(ctx, "/"+name, false, "Usage: "+cmd.Usage)
+		return
+	}
+
+	reply, err := cmd.Run(ctx, args)
+	if err != nil {
+		fail(ctx, "/"+name, err)
+		return
+	}
+	if reply != "" {
+		result(ctx, "/"+name, true, reply)
+	}
+}
+
+// fail answers the client frame carrying a command that did not run with the
+// reason of err, when it is a Refusal
+func fail(ctx *Context, command string, err error) {
+	var refusal *Refusal
+	if errors.As(err, &refusal) {
+		result(ctx, command, false, refusal.Reason)
+		return
+	}
+
+	log.Printf("Failed to run %s for %s: %v", command, ctx.Client.Username(), err)
+	result(ctx, command, false, fmt.Sprintf("Sorry, %s failed. Please try again later.", command))
+}
+
+// result answers the client frame carrying a command
+func result(ctx *Context, command string, ok bool, content string) {
+	envelope, err := protocol.NewEnvelope(protocol.TypeCommandResult, protocol.CommandResultEvent{
+		Command: command,
+		OK:      ok,
+		Content: content,
+	})
+	if err != nil {
+		return
+	}
+	envelope.ID = ctx.FrameID
+
+	ctx.Client.Send(envelope)
+}
@@ -0,0 +1,230 @@
+package commands
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+// connect joins room as username, it returns the server side client and the peer connection
+func connect(t *testing.T, room *chat.Room, username string) (*chat.Client, *websocket.Conn) {
+	t.Helper()
+
+	clients := make(chan *chat.Client, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := chat.NewClient(conn, username, chat.DefaultClientConfig())
+		defer client.Close()
+
+		defer room.Leave(client)
+		room.Join(client)
+		clients <- client
+		for {
+			if _, err := client.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return <-clients, conn
+}
+
+// readEvent reads frames until one of eventType, decoding it into v
+func readEvent(t *testing.T, conn *websocket.Conn, eventType string, v interface{}) protocol.Envelope {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var envelope protocol.Envelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			t.Fatalf("failed to read %s event: %v", eventType, err)
+		}
+		if envelope.Type == eventType {
+			if err := envelope.Decode(v); err != nil {
+				t.Fatalf("failed to decode %s event: %v", eventType, err)
+			}
+			return envelope
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		content string
+		name    string
+		raw     string
+	}{
+		{"/help", "help", ""},
+		{"/stock=AAPL.US", "stock", "AAPL.US"},
+		{"/nick  Bobby ", "nick", "Bobby"},
+		{"/me waves at everyone", "me", "waves at everyone"},
+		{"/WHO", "who", ""},
+	}
+
+	for _, tc := range testCases {
+		name, raw := Parse(tc.content)
+		if name != tc.name || raw != tc.raw {
+			t.Errorf("Parse(%q): got %q, %q want %q, %q", tc.content, name, raw, tc.name, tc.raw)
+		}
+	}
+}
+
+func TestRegistry_Register(t *testing.T) {
+	registry := NewRegistry()
+	run := func(ctx *Context, args []string) (string, error) { return "", nil }
+
+	if err := registry.Register(Command{Name: "ping", Run: run}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.Register(Command{Name: "ping", Run: run}); !errors.Is(err, ErrDuplicateCommand) {
+		t.Errorf("expected ErrDuplicateCommand, got %v", err)
+	}
+	if err := registry.Register(Command{Name: "Not valid", Run: run}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected ErrInvalidName, got %v", err)
+	}
+	if cmd, ok := registry.Lookup("ping"); !ok || cmd.Usage != "/ping" {
+		t.Errorf("unexpected command: %+v", cmd)
+	}
+}
+
+func TestRegistry_Execute(t *testing.T) {
+	room, _ := chat.NewHub(storage.NewMemoryMessageStore()).Room(chat.DefaultRoom)
+	client, conn := connect(t, room, "testuser")
+
+	registry := NewRegistry()
+	registry.Register(Command{
+		Name:    "echo",
+		Usage:   "/echo <word>",
+		Help:    "Repeat a word",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(ctx *Context, args []string) (string, error) {
+			return args[0], nil
+		},
+	})
+	registry.Register(Command{
+		Name:       "secret",
+		Help:       "Nobody may run this",
+		Permission: func(ctx *Context) error { return Refuse("You are not allowed to do that.") },
+		Run: func(ctx *Context, args []string) (string, error) {
+			t.Error("command ran without permission")
+			return "", nil
+		},
+	})
+	registry.Register(Command{
+		Name: "broken",
+		Run: func(ctx *Context, args []string) (string, error) {
+			return "", errors.New("database is locked")
+		},
+	})
+
+	testCases := []struct {
+		content string
+		ok      bool
+		reply   string
+	}{
+		{"/echo hello", true, "hello"},
+		{"/echo", false, "Usage: /echo <word>"},
+		{"/echo hello world", false, "Usage: /echo <word>"},
+		{"/secret", false, "You are not allowed to do that."},
+		{"/broken", false, "Sorry, /broken failed. Please try again later."},
+		{"/dance", false, "I'm sorry, I didn't understand /dance. Type /help to list the commands."},
+	}
+
+	for i, tc := range testCases {
+		id := string(rune('a' + i))
+		registry.Execute(&Context{Client: client, Room: room, FrameID: id}, tc.content)
+
+		var result protocol.CommandResultEvent
+		envelope := readEvent(t, conn, protocol.TypeCommandResult, &result)
+		if envelope.ID != id || result.OK != tc.ok || result.Content != tc.reply {
+			t.Errorf("%s: unexpected result: %+v %+v", tc.content, envelope, result)
+		}
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	room, _ := chat.NewHub(storage.NewMemoryMessageStore()).Room(chat.DefaultRoom)
+	client, conn := connect(t, room, "bob")
+	connect(t, room, "alice")
+
+	execute := func(content string) protocol.CommandResultEvent {
+		t.Helper()
+		Default.Execute(&Context{Client: client, Room: room, FrameID: "1"}, content)
+
+		var result protocol.CommandResultEvent
+		readEvent(t, conn, protocol.TypeCommandResult, &result)
+		return result
+	}
+
+	help := execute("/help")
+	for _, usage := range []string{"/help [command]", "/me <action>", "/nick [nickname]", "/who"} {
+		if !strings.Contains(help.Content, usage) {
+			t.Errorf("expected /help to list %q, got %q", usage, help.Content)
+		}
+	}
+	if result := execute("/help nick"); !result.OK || !strings.HasPrefix(result.Content, "/nick [nickname]: ") {
+		t.Errorf("unexpected /help nick: %+v", result)
+	}
+	if result := execute("/help dance"); result.OK {
+		t.Errorf("unexpected /help dance: %+v", result)
+	}
+
+	if result := execute("/nick not valid!"); result.OK {
+		t.Errorf("unexpected /nick result: %+v", result)
+	}
+	if result := execute("/nick Bobby"); !result.OK || client.Nickname() != "Bobby" {
+		t.Errorf("unexpected /nick result: %+v, nickname %q", result, client.Nickname())
+	}
+	if result := execute("/who"); result.Content != "Online in #general: alice, Bobby (bob)" {
+		t.Errorf("unexpected /who result: %+v", result)
+	}
+
+	// The ack and the broadcast message may arrive in any order
+	Default.Execute(&Context{Client: client, Room: room, FrameID: "2"}, "/me waves")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var message models.Message
+	acked := false
+	for message.Content == "" || !acked {
+		var envelope protocol.Envelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			t.Fatalf("failed to read /me answer: %v", err)
+		}
+		switch envelope.Type {
+		case protocol.TypeMessage:
+			envelope.Decode(&message)
+		case protocol.TypeAck:
+			var ack protocol.AckEvent
+			envelope.Decode(&ack)
+			acked = ack.ID == "2"
+		}
+	}
+	if message.Content != "* Bobby waves" || message.Username != "bob" || message.Nickname != "Bobby" {
+		t.Errorf("unexpected /me message: %+v", message)
+	}
+
+	if result := execute("/nick"); !result.OK || client.Nickname() != "" {
+		t.Errorf("unexpected /nick result: %+v, nickname %q", result, client.Nickname())
+	}
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// messagePage is a page of room history returned by the messages API
+type messagePage struct {
+	Messages []models.Message `json:"messages"`
+	HasMore  bool             `json:"has_more"`
+}
+
+// ServeRoomMessages handles GET /api/rooms/{room}/messages, paging through a room's history.
+// The before and after query parameters are message ID cursors, at most one may be given.
+// Without a cursor the most recent messages are returned. Messages are always oldest first.
+func ServeRoomMessages(hub *chat.Hub, messages storage.MessageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if _, err := ParseJWTToken(requestToken(r)); err != nil {
+			writeJSONError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		name, ok := parseRoomMessagesPath(r.URL.Path)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if _, err := hub.Room(name); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		query := r.URL.Query()
+		before, err := parseCursor(query.Get("before"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid before cursor")
+			return
+		}
+		after, err := parseCursor(query.Get("after"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid after cursor")
+			return
+		}
+		if before > 0 && after > 0 {
+			writeJSONError(w, http.StatusBadRequest, "before and after cannot be combined")
+			return
+		}
+
+		limit := defaultPageSize
+		if value := query.Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > maxPageSize {
+				writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageSize))
+				return
+			}
+		}
+
+		// Fetch one extra message to know whether there is more to page through
+		var page []models.Message
+		if after > 0 {
+			page, err = messages.MessagesAfter(name, after, limit+1)
+		} else {
+			page, err = messages.MessagesBefore(name, before, limit+1)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to load messages")
+			return
+		}
+
+		hasMore := len(page) > limit
+		if hasMore {
+			if after > 0 {
+				page = page[:limit]
+			} else {
+				page = page[1:]
+			}
+		}
+
+		writeJSON(w, http.StatusOK, messagePage{Messages: page, HasMore: hasMore})
+	}
+}
+
+// parseRoomMessagesPath extracts the room from a /api/rooms/{room}/messages path
+func parseRoomMessagesPath(path string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/rooms/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "messages" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// parseCursor parses a message ID cursor, an empty value means no cursor
+func parseCursor(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	cursor, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || cursor < 1 {
+		return 0, strconv.ErrSyntax
+	}
+	return cursor, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+func TestServeRoomMessages(t *testing.T) {
+	messages := storage.NewMemoryMessageStore()
+	for i := 1; i <= 10; i++ {
+		messages.AppendMessage(models.Message{Room: chat.DefaultRoom, Username: "testuser", Content: fmt.Sprintf("message %d", i)})
+	}
+	handler := ServeRoomMessages(chat.NewHub(messages), messages)
+	token := GenerateToken("testuser")
+
+	testCases := []struct {
+		name           string
+		target         string
+		expectedStatus int
+		expectedIDs    []int64
+		expectedMore   bool
+	}{
+		{"latest", "/api/rooms/general/messages?limit=3", http.StatusOK, []int64{8, 9, 10}, true},
+		{"before", "/api/rooms/general/messages?before=8&limit=3", http.StatusOK, []int64{5, 6, 7}, true},
+		{"before start", "/api/rooms/general/messages?before=3&limit=3", http.StatusOK, []int64{1, 2}, false},
+		{"after", "/api/rooms/general/messages?after=2&limit=3", http.StatusOK, []int64{3, 4, 5}, true},
+		{"after end", "/api/rooms/general/messages?after=8", http.StatusOK, []int64{9, 10}, false},
+		{"both cursors", "/api/rooms/general/messages?before=8&after=2", http.StatusBadRequest, nil, false},
+		{"invalid cursor", "/api/rooms/general/messages?before=abc", http.StatusBadRequest, nil, false},
+		{"invalid limit", "/api/rooms/general/messages?limit=1000", http.StatusBadRequest, nil, false},
+		{"unknown room", "/api/rooms/missing/messages", http.StatusNotFound, nil, false},
+		{"unknown path", "/api/rooms/general/members", http.StatusNotFound, nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tc.expectedStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tc.expectedStatus)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var page messagePage
+			if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if len(page.Messages) != len(tc.expectedIDs) {
+				t.Fatalf("unexpected messages: %+v", page.Messages)
+			}
+			for i, id := range tc.expectedIDs {
+				if page.Messages[i].ID != id {
+					t.Errorf("unexpected message at %d: got ID %v, want %v", i, page.Messages[i].ID, id)
+				}
+			}
+			if page.HasMore != tc.expectedMore {
+				t.Errorf("unexpected has_more: got %v, want %v", page.HasMore, tc.expectedMore)
+			}
+		})
+	}
+}
+
+func TestServeRoomMessages_Unauthenticated(t *testing.T) {
+	messages := storage.NewMemoryMessageStore()
+	handler := ServeRoomMessages(chat.NewHub(messages), messages)
+
+	req, err := http.NewRequest("GET", "/api/rooms/general/messages?token=invalid-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
@@ -1,19 +1,42 @@
 package handlers
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"errors"
 	"fmt"
+	"html/template"
+	"log"
 	"net/http"
-	"text/template"
+	"net/url"
+	"regexp"
+	"strings"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/auth"
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
 )
 
-var store = sessions.NewCookieStore([]byte("secret-key"))
+const (
+	tokenCookie        = "token"         // the access token of a logged in browser
+	refreshTokenCookie = "refresh_token" // the refresh token, only sent to the refresh endpoint
+	refreshTokenPath   = "/token/refresh"
+
+	botUsername = "Bot" // the author of the stock replies, nobody can register it
+)
+
+// usernamePattern keeps usernames safe to show anywhere and to put in cookies
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
 var jwtSecret = []byte("secret-key")
+var passwords = auth.DefaultPasswords()
+var tokens = auth.NewTokenManager(auth.DefaultTokenConfig(jwtSecret), storage.NewMemoryRevocationStore())
+
+// UseTokenManager replaces the token manager issuing and validating tokens, by default
+// tokens are signed with a fixed secret and revocations are only kept in memory
+func UseTokenManager(manager *auth.TokenManager) {
+	tokens = manager
+}
 
 // ServeHome serves the home page
 func ServeHome(templates *template.Template) http.HandlerFunc {
@@ -25,20 +48,27 @@ func ServeHome(templates *template.Template) http.HandlerFunc {
 }
 
 // RegisterHandler serves the registration page
-func RegisterHandler(templates *template.Template) http.HandlerFunc {
+func RegisterHandler(templates *template.Template, users storage.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			username := r.FormValue("username")
 			password := r.FormValue("password")
+			if !validUsername(username) || password == "" {
+				http.Redirect(w, r, "/register", http.StatusSeeOther)
+				return
+			}
 
-			session, err := store.Get(r, username)
+			hash, err := passwords.Hash(password)
+			if err != nil {
+				http.Redirect(w, r, "/register", http.StatusSeeOther)
+				return
+			}
+
+			_, err = users.CreateUser(username, hash)
 			if err != nil {
 				http.Redirect(w, r, "/register", http.StatusSeeOther)
 				return
 			}
-			session.Values["authenticated"] = false
-			session.Values["password"] = GetMD5Hash(password)
-			session.Save(r, w)
 
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 		} else {
@@ -47,73 +77,217 @@ func RegisterHandler(templates *template.Template) http.HandlerFunc {
 	}
 }
 
+// validUsername reports whether username can be registered, it must be 1-32
+// letters, digits, '_', '.' or '-' and must not be the bot's
+func validUsername(username string) bool {
+	return usernamePattern.MatchString(username) && !strings.EqualFold(username, botUsername)
+}
+
 // LoginHandler serves the login page
-func LoginHandler(templates *template.Template) http.HandlerFunc {
+func LoginHandler(templates *template.Template, users storage.UserStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			username := r.FormValue("username")
 			password := r.FormValue("password")
 
-			session, err := store.Get(r, username)
-			if err != nil {
+			user, err := users.GetUser(username)
+			if err != nil || user.Disabled {
 				http.Redirect(w, r, "/login", http.StatusSeeOther)
 				return
 			}
-			if pass, ok := session.Values["password"].(string); !ok || pass != GetMD5Hash(password) {
+
+			ok, upgraded, err := passwords.Verify(password, user.PasswordHash)
+			if err != nil || !ok {
 				http.Redirect(w, r, "/login", http.StatusSeeOther)
 				return
 			}
-			session.Values["authenticated"] = true
-			session.Save(r, w)
 
-			token, err := GenerateJWTToken(username)
+			// Transparently move the account to the preferred hash format
+			if upgraded != "" {
+				if err := users.UpdatePassword(username, upgraded); err != nil {
+					log.Printf("Failed to upgrade password hash for %s: %v", username, err)
+				}
+			}
+
+			pair, err := tokens.Issue(username)
 			if err != nil {
 				http.Redirect(w, r, "/login", http.StatusSeeOther)
 				return
 			}
+			setTokenCookies(w, pair)
 
-			// If login is successful, set session and redirect to chat
-			http.Redirect(w, r, fmt.Sprintf("/chat?token=%s", token), http.StatusSeeOther)
+			// If login is successful, redirect to chat
+			http.Redirect(w, r, fmt.Sprintf("/chat?token=%s", pair.AccessToken), http.StatusSeeOther)
 		} else {
 			templates.ExecuteTemplate(w, "login.html", nil)
 		}
 	}
 }
 
-// GenerateJWTToken generates a JWT token
-func GenerateJWTToken(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-	})
+// LogoutHandler revokes the tokens of the request, clears the login cookies and
+// disconnects the live WebSockets of the user before redirecting to the login page
+func LogoutHandler(hub *chat.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 
-	tokenString, err := token.SignedString(jwtSecret)
-	if err != nil {
-		return "", err
+		token := requestToken(r)
+		if token == "" {
+			token = r.FormValue("token")
+		}
+		username, err := ParseJWTToken(token)
+		if err == nil {
+			if err := tokens.Revoke(token); err != nil {
+				log.Printf("Failed to revoke access token of %s: %v", username, err)
+			}
+
+			hub.Disconnect(username, protocol.ErrLoggedOut, "logged out")
+		}
+
+		if cookie, err := r.Cookie(refreshTokenCookie); err == nil {
+			if err := tokens.Revoke(cookie.Value); err != nil {
+				log.Printf("Failed to revoke refresh token: %v", err)
+			}
+		}
+
+		clearTokenCookies(w)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	}
+}
 
-	return tokenString, nil
+// RefreshTokenHandler exchanges a refresh token, from the refresh_token form value
+// or cookie, for a new token pair. The presented refresh token is consumed.
+// Accounts that were disabled or deleted cannot refresh.
+func RefreshTokenHandler(users storage.UserStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		refreshToken := r.FormValue("refresh_token")
+		if cookie, err := r.Cookie(refreshTokenCookie); refreshToken == "" && err == nil {
+			refreshToken = cookie.Value
+		}
+
+		pair, err := tokens.Refresh(refreshToken, activeAccount(users))
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		setTokenCookies(w, pair)
+
+		writeJSON(w, http.StatusOK, tokenResponse{
+			AccessToken:  pair.AccessToken,
+			RefreshToken: pair.RefreshToken,
+			ExpiresIn:    int64(tokens.Config().AccessTokenLifetime.Seconds()),
+		})
+	}
 }
 
-// ParseJWTToken parses a JWT token
-func ParseJWTToken(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
+// activeAccount refuses the accounts that were disabled or deleted
+func activeAccount(users storage.UserStore) func(username string) error {
+	return func(username string) error {
+		user, err := users.GetUser(username)
+		if err != nil {
+			return err
+		}
+		if user.Disabled {
+			return auth.ErrAccountDisabled
+		}
+		return nil
+	}
+}
+
+// tokenResponse is returned by the refresh endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds until the access token expires
+}
+
+// setTokenCookies stores a token pair in cookies hidden from scripts. The access token
+// cookie lets the browser authenticate its WebSocket, the refresh token cookie is
+// only sent to the refresh endpoint.
+func setTokenCookies(w http.ResponseWriter, pair auth.TokenPair) {
+	config := tokens.Config()
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    pair.AccessToken,
+		Path:     "/",
+		MaxAge:   int(config.AccessTokenLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    pair.RefreshToken,
+		Path:     refreshTokenPath,
+		MaxAge:   int(config.RefreshTokenLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// clearTokenCookies removes the cookies set by setTokenCookies
+func clearTokenCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: tokenCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.SetCookie(w, &http.Cookie{Name: refreshTokenCookie, Path: refreshTokenPath, MaxAge: -1, HttpOnly: true})
+}
+
+// GenerateJWTToken generates a JWT access token
+func GenerateJWTToken(username string) (string, error) {
+	token, _, err := tokens.GenerateAccessToken(username)
+	return token, err
+}
+
+// ParseJWTToken validates a JWT access token and returns its username
+func ParseJWTToken(tokenString string) (string, error) {
+	claims, err := tokens.ParseAccessToken(tokenString)
 	if err != nil {
 		return "", err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if username, exists := claims["username"].(string); exists {
-			return username, nil
+	return claims.Username, nil
+}
+
+// requestToken returns the token of a request, looking in order at the Authorization
+// header, the WebSocket subprotocols, the token cookie and the token query parameter
+func requestToken(r *http.Request) string {
+	token, _ := findToken(r)
+	return token
+}
+
+// findToken implements requestToken, fromCookie tells that the token came from
+// the token cookie, which browsers also send with requests of other sites
+func findToken(r *http.Request) (token string, fromCookie bool) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer "), false
+	}
+
+	for _, subprotocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(subprotocol, protocol.TokenSubprotocolPrefix) {
+			return strings.TrimPrefix(subprotocol, protocol.TokenSubprotocolPrefix), false
 		}
 	}
 
-	return "", errors.New("invalid token")
+	if cookie, err := r.Cookie(tokenCookie); err == nil {
+		return cookie.Value, true
+	}
+
+	return r.URL.Query().Get("token"), false
 }
 
-func GetMD5Hash(text string) string {
-	hasher := md5.New()
-	hasher.Write([]byte(text))
-	return hex.EncodeToString(hasher.Sum(nil))
+// sameOrigin reports whether a browser request comes from a page of this
+// server, requests without an Origin header do not come from a browser
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
 }
@@ -1,15 +1,23 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
-	"text/template"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+
+	"github.com/andrerussowsky/chat-app/internal/auth"
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
 )
 
 func TestServeHome(t *testing.T) {
@@ -35,7 +43,7 @@ func TestRegisterHandler_ServeForm(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handler := RegisterHandler(template.New(""))
+	handler := RegisterHandler(template.New(""), storage.NewMemoryUserStore())
 
 	handler.ServeHTTP(rr, req)
 
@@ -58,7 +66,7 @@ func TestRegisterHandler_SubmitForm(t *testing.T) {
 
 	mockTemplate := template.New("")
 	rr := httptest.NewRecorder()
-	handler := RegisterHandler(mockTemplate)
+	handler := RegisterHandler(mockTemplate, storage.NewMemoryUserStore())
 
 	handler.ServeHTTP(rr, req)
 
@@ -67,6 +75,30 @@ func TestRegisterHandler_SubmitForm(t *testing.T) {
 	}
 }
 
+func TestRegisterHandler_InvalidUsername(t *testing.T) {
+	users := storage.NewMemoryUserStore()
+	handler := RegisterHandler(template.New(""), users)
+
+	for _, username := range []string{"", "john doe", "<img src=x>", "Bot", "bot", strings.Repeat("a", 33)} {
+		formValues := url.Values{"username": {username}, "password": {"testpassword"}}
+		req, err := http.NewRequest("POST", "/register", strings.NewReader(formValues.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if location := rr.Header().Get("Location"); location != "/register" {
+			t.Errorf("expected %q to be refused, got redirect to %v", username, location)
+		}
+		if _, err := users.GetUser(username); err == nil {
+			t.Errorf("expected %q not to be registered", username)
+		}
+	}
+}
+
 func TestLoginHandler_ServeForm(t *testing.T) {
 	req, err := http.NewRequest("GET", "/login", nil)
 	if err != nil {
@@ -74,7 +106,7 @@ func TestLoginHandler_ServeForm(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	handler := LoginHandler(template.New(""))
+	handler := LoginHandler(template.New(""), storage.NewMemoryUserStore())
 
 	handler.ServeHTTP(rr, req)
 
@@ -97,7 +129,7 @@ func TestLoginHandler_SubmitForm(t *testing.T) {
 
 	mockTemplate := template.New("")
 	rr := httptest.NewRecorder()
-	handler := LoginHandler(mockTemplate)
+	handler := LoginHandler(mockTemplate, storage.NewMemoryUserStore())
 
 	handler.ServeHTTP(rr, req)
 
@@ -106,6 +138,217 @@ func TestLoginHandler_SubmitForm(t *testing.T) {
 	}
 }
 
+func TestLoginHandler_AccountPersistsAcrossBrowsers(t *testing.T) {
+	users := storage.NewMemoryUserStore()
+	formValues := url.Values{
+		"username": {"testuser_persist"},
+		"password": {"testpassword_persist"},
+	}
+
+	submit := func(handler http.HandlerFunc, path string, values url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, strings.NewReader(values.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := submit(RegisterHandler(template.New(""), users), "/register", formValues)
+	if location := rr.Header().Get("Location"); location != "/login" {
+		t.Fatalf("unexpected register redirect: got %v want %v", location, "/login")
+	}
+
+	// A fresh request carries none of the cookies set during registration
+	rr = submit(LoginHandler(template.New(""), users), "/login", formValues)
+	if location := rr.Header().Get("Location"); !strings.HasPrefix(location, "/chat?token=") {
+		t.Errorf("expected redirect to chat, got %v", location)
+	}
+
+	formValues.Set("password", "wrong-password")
+	rr = submit(LoginHandler(template.New(""), users), "/login", formValues)
+	if location := rr.Header().Get("Location"); location != "/login" {
+		t.Errorf("expected redirect to login for wrong password, got %v", location)
+	}
+
+	users.DisableUser("testuser_persist")
+	formValues.Set("password", "testpassword_persist")
+	rr = submit(LoginHandler(template.New(""), users), "/login", formValues)
+	if location := rr.Header().Get("Location"); location != "/login" {
+		t.Errorf("expected redirect to login for disabled user, got %v", location)
+	}
+}
+
+func TestLoginHandler_UpgradesLegacyHash(t *testing.T) {
+	users := storage.NewMemoryUserStore()
+	legacy, _ := auth.MD5Hasher{}.Hash("testpassword_legacy")
+	users.CreateUser("testuser_legacy", legacy)
+
+	formValues := url.Values{
+		"username": {"testuser_legacy"},
+		"password": {"testpassword_legacy"},
+	}
+	req, err := http.NewRequest("POST", "/login", strings.NewReader(formValues.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	LoginHandler(template.New(""), users).ServeHTTP(rr, req)
+
+	if location := rr.Header().Get("Location"); !strings.HasPrefix(location, "/chat?token=") {
+		t.Fatalf("expected redirect to chat, got %v", location)
+	}
+
+	user, _ := users.GetUser("testuser_legacy")
+	if user.PasswordHash == legacy || !strings.HasPrefix(user.PasswordHash, "$argon2id$") {
+		t.Errorf("expected legacy hash to be upgraded, got %v", user.PasswordHash)
+	}
+}
+
+func TestLogoutHandler(t *testing.T) {
+	hub := chat.NewHub(storage.NewMemoryMessageStore())
+	server := httptest.NewServer(ServeWebSocket(hub, chat.DefaultClientConfig(), nil, false))
+	defer server.Close()
+
+	pair, err := tokens.Issue("testuser_logout")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialRoom(t, server.URL, chat.DefaultRoom, "testuser_logout")
+	defer conn.Close()
+	var history protocol.HistoryEvent
+	readEvent(t, conn, protocol.TypeHistory, &history)
+
+	req, err := http.NewRequest("POST", "/logout", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: tokenCookie, Value: pair.AccessToken})
+	req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: pair.RefreshToken})
+
+	rr := httptest.NewRecorder()
+	LogoutHandler(hub).ServeHTTP(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/login" {
+		t.Errorf("unexpected redirect: got %v want %v", location, "/login")
+	}
+	cleared := map[string]bool{}
+	for _, cookie := range rr.Result().Cookies() {
+		cleared[cookie.Name] = cookie.MaxAge < 0
+	}
+	if !cleared[tokenCookie] || !cleared[refreshTokenCookie] {
+		t.Errorf("expected token cookies to be cleared, got %v", rr.Result().Cookies())
+	}
+
+	// Both tokens of the session are revoked
+	if _, err := ParseJWTToken(pair.AccessToken); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected access token to be revoked, got %v", err)
+	}
+	if _, err := tokens.Refresh(pair.RefreshToken, nil); !errors.Is(err, auth.ErrTokenRevoked) {
+		t.Errorf("expected refresh token to be revoked, got %v", err)
+	}
+
+	// The live socket of the user is told and disconnected
+	var errorEvent protocol.ErrorEvent
+	readEvent(t, conn, protocol.TypeError, &errorEvent)
+	if errorEvent.Code != protocol.ErrLoggedOut {
+		t.Errorf("unexpected error event: %+v", errorEvent)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected policy violation close, got %v", err)
+	}
+
+	// And the revoked token cannot open a new one
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.Version1}}
+	header := http.Header{"Authorization": {"Bearer " + pair.AccessToken}}
+	refused, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer refused.Close()
+	readEvent(t, refused, protocol.TypeError, &errorEvent)
+	if errorEvent.Code != protocol.ErrInvalidToken {
+		t.Errorf("expected revoked token to be refused, got %+v", errorEvent)
+	}
+}
+
+func TestRefreshTokenHandler(t *testing.T) {
+	users := storage.NewMemoryUserStore()
+	users.CreateUser("testuser_refresh", "hash")
+	pair, err := tokens.Issue("testuser_refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func(refreshToken string, asCookie bool) *httptest.ResponseRecorder {
+		var req *http.Request
+		if asCookie {
+			req, _ = http.NewRequest("POST", "/token/refresh", nil)
+			req.AddCookie(&http.Cookie{Name: refreshTokenCookie, Value: refreshToken})
+		} else {
+			form := url.Values{"refresh_token": {refreshToken}}
+			req, _ = http.NewRequest("POST", "/token/refresh", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		rr := httptest.NewRecorder()
+		RefreshTokenHandler(users).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := refresh(pair.RefreshToken, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var response tokenResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if username, err := ParseJWTToken(response.AccessToken); err != nil || username != "testuser_refresh" {
+		t.Errorf("unexpected refreshed access token: %v, %v", username, err)
+	}
+	if response.ExpiresIn <= 0 {
+		t.Errorf("unexpected expires_in: %v", response.ExpiresIn)
+	}
+
+	cookies := map[string]bool{}
+	for _, cookie := range rr.Result().Cookies() {
+		cookies[cookie.Name] = cookie.HttpOnly
+	}
+	if !cookies[tokenCookie] || !cookies[refreshTokenCookie] {
+		t.Errorf("expected http-only token cookies, got %v", rr.Result().Cookies())
+	}
+
+	// Refresh tokens are rotated, the old one is refused
+	if rr := refresh(pair.RefreshToken, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected reused refresh token to be refused, got %v", rr.Code)
+	}
+	if rr := refresh(response.RefreshToken, false); rr.Code != http.StatusOK {
+		t.Errorf("expected rotated refresh token to work, got %v", rr.Code)
+	}
+	if rr := refresh(response.AccessToken, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected access token to be refused, got %v", rr.Code)
+	}
+
+	// Disabled and deleted accounts cannot refresh
+	disabled, _ := tokens.Issue("testuser_refresh")
+	users.DisableUser("testuser_refresh")
+	if rr := refresh(disabled.RefreshToken, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected disabled account to be refused, got %v", rr.Code)
+	}
+	deleted, _ := tokens.Issue("testuser_deleted")
+	if rr := refresh(deleted.RefreshToken, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected unknown account to be refused, got %v", rr.Code)
+	}
+}
+
 func TestGenerateJWTToken(t *testing.T) {
 	testCases := []struct {
 		username string
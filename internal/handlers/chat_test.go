@@ -1,23 +1,30 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
-	"text/template"
 	"time"
 
+	"github.com/andrerussowsky/chat-app/internal/bot"
+	"github.com/andrerussowsky/chat-app/internal/broker"
+	"github.com/andrerussowsky/chat-app/internal/chat"
 	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/rabbitmq"
+	"github.com/andrerussowsky/chat-app/internal/stock"
+	"github.com/andrerussowsky/chat-app/internal/storage"
 	"github.com/gorilla/websocket"
 )
 
 func TestServeWebSocket(t *testing.T) {
-	mockToken := "mock-jwt-token"
 	mockMessage := models.Message{
-		Token:    mockToken,
-		Content:  "Hello, world!",
+		Content:  "Hello, chat.DefaultClientConfig(), world!",
 		Username: "testuser",
 	}
 
@@ -51,9 +58,6 @@ func TestServeWebSocket(t *testing.T) {
 	}
 
 	// Validate the received message
-	if receivedMessage.Token != mockToken {
-		t.Errorf("unexpected token in received message: got %v, want %v", receivedMessage.Token, mockToken)
-	}
 	if receivedMessage.Content != mockMessage.Content {
 		t.Errorf("unexpected content in received message: got %v, want %v", receivedMessage.Content, mockMessage.Content)
 	}
@@ -62,59 +66,259 @@ func TestServeWebSocket(t *testing.T) {
 	}
 }
 
-func TestHandleMessages(t *testing.T) {
-	// Create a mock WebSocket server
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		upgrader.CheckOrigin = func(r *http.Request) bool { return true }
-		conn, _ := upgrader.Upgrade(w, r, nil)
-		defer conn.Close()
+// readEvent reads envelopes from conn until one of the given type arrives and decodes its data into v
+func readEvent(t *testing.T, conn *websocket.Conn, eventType string, v interface{}) protocol.Envelope {
+	t.Helper()
 
-		// Create a mock message
-		mockMessage := models.Message{
-			Token:    "mock-token",
-			Content:  "Hello, world!",
-			Username: "testuser",
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var received protocol.Envelope
+		if err := conn.ReadJSON(&received); err != nil {
+			t.Fatalf("failed to read %s event from WebSocket connection: %v", eventType, err)
+		}
+		if received.Type != eventType {
+			continue
+		}
+		if err := received.Decode(v); err != nil {
+			t.Fatalf("failed to decode %s event: %v", eventType, err)
 		}
+		return received
+	}
+}
 
-		// Send the mock message to the broadcast channel
-		broadcast <- mockMessage
+// sendFrame writes a client frame to conn
+func sendFrame(t *testing.T, conn *websocket.Conn, eventType, id string, data interface{}) {
+	t.Helper()
 
-		// Read the message sent by the broadcast channel
-		var receivedMessage models.Message
-		err := conn.ReadJSON(&receivedMessage)
-		if err != nil {
-			t.Errorf("failed to read message from WebSocket connection: %v", err)
-		}
+	envelope, err := protocol.NewEnvelope(eventType, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.ID = id
+	if err := conn.WriteJSON(envelope); err != nil {
+		t.Fatalf("failed to write frame to WebSocket connection: %v", err)
+	}
+}
 
-		// Validate the received message
-		if receivedMessage.Token != mockMessage.Token {
-			t.Errorf("unexpected token in received message: got %v, want %v", receivedMessage.Token, mockMessage.Token)
-		}
-		if receivedMessage.Content != mockMessage.Content {
-			t.Errorf("unexpected content in received message: got %v, want %v", receivedMessage.Content, mockMessage.Content)
+// dialRoom connects to the WebSocket server at serverURL for room as username with the current protocol version
+func dialRoom(t *testing.T, serverURL, room, username string) *websocket.Conn {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.Version1}}
+	header := http.Header{"Authorization": {"Bearer " + GenerateToken(username)}}
+	u := "ws" + strings.TrimPrefix(serverURL, "http") + "/?room=" + room
+	conn, _, err := dialer.Dial(u, header)
+	if err != nil {
+		t.Fatalf("failed to connect to WebSocket server: %v", err)
+	}
+	if conn.Subprotocol() != protocol.Version1 {
+		t.Errorf("unexpected negotiated protocol: got %v want %v", conn.Subprotocol(), protocol.Version1)
+	}
+	return conn
+}
+
+func TestServeWebSocket_Rooms(t *testing.T) {
+	messages := storage.NewMemoryMessageStore()
+	messages.AppendMessage(models.Message{Room: "project-x", Username: "olduser", Content: "Earlier message"})
+	hub := chat.NewHub(messages)
+
+	server := httptest.NewServer(ServeWebSocket(hub, chat.DefaultClientConfig(), nil, false))
+	defer server.Close()
+
+	general := dialRoom(t, server.URL, chat.DefaultRoom, "otheruser")
+	defer general.Close()
+	projectX := dialRoom(t, server.URL, "project-x", "testuser")
+	defer projectX.Close()
+
+	// Each connection gets the history of its own room once
+	var history protocol.HistoryEvent
+	readEvent(t, general, protocol.TypeHistory, &history)
+	if history.Room != chat.DefaultRoom || len(history.Messages) != 0 {
+		t.Errorf("unexpected history in general: %+v", history)
+	}
+	readEvent(t, projectX, protocol.TypeHistory, &history)
+	if history.Room != "project-x" || len(history.Messages) != 1 || history.Messages[0].Content != "Earlier message" {
+		t.Errorf("unexpected history in project-x: %+v", history)
+	}
+
+	// Send a message to project-x only
+	sendFrame(t, projectX, protocol.TypeMessage, "1", protocol.SendMessage{Content: "Hello, project!"})
+
+	var presence protocol.PresenceEvent
+	readEvent(t, projectX, protocol.TypePresence, &presence)
+	if len(presence.Members) != 1 || presence.Members[0] != "testuser" {
+		t.Errorf("unexpected presence in project-x: %+v", presence)
+	}
+
+	// Only the new message is delivered, not the whole history again
+	var received models.Message
+	readEvent(t, projectX, protocol.TypeMessage, &received)
+	if received.Content != "Hello, project!" || received.Room != "project-x" || received.Username != "testuser" || received.ID == 0 {
+		t.Errorf("unexpected message in project-x: %+v", received)
+	}
+
+	// The general room must not see it
+	general.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		var envelope protocol.Envelope
+		if err := general.ReadJSON(&envelope); err != nil {
+			break
 		}
-		if receivedMessage.Username != mockMessage.Username {
-			t.Errorf("unexpected username in received message: got %v, want %v", receivedMessage.Username, mockMessage.Username)
+		if envelope.Type == protocol.TypeMessage {
+			t.Errorf("unexpected message in general room: %s", envelope.Data)
 		}
-	}))
+	}
+}
+
+func TestServeWebSocket_Frames(t *testing.T) {
+	server := httptest.NewServer(ServeWebSocket(chat.NewHub(storage.NewMemoryMessageStore()), chat.DefaultClientConfig(), nil, false))
 	defer server.Close()
 
-	// Connect to the mock WebSocket server
+	conn := dialRoom(t, server.URL, chat.DefaultRoom, "testuser")
+	defer conn.Close()
+
+	sendFrame(t, conn, protocol.TypeMessage, "1", protocol.SendMessage{Content: "Hello"})
+	var ack protocol.AckEvent
+	readEvent(t, conn, protocol.TypeAck, &ack)
+	if ack.ID != "1" {
+		t.Errorf("unexpected ack: %+v", ack)
+	}
+
+	sendFrame(t, conn, "shout", "2", nil)
+	var errorEvent protocol.ErrorEvent
+	envelope := readEvent(t, conn, protocol.TypeError, &errorEvent)
+	if envelope.ID != "2" || errorEvent.Code != protocol.ErrUnsupportedType {
+		t.Errorf("unexpected error event: %+v %+v", envelope, errorEvent)
+	}
+
+	sendFrame(t, conn, protocol.TypeMessage, "3", protocol.SendMessage{Content: "/dance"})
+	var result protocol.CommandResultEvent
+	readEvent(t, conn, protocol.TypeCommandResult, &result)
+	if result.OK || result.Command != "/dance" {
+		t.Errorf("unexpected command result: %+v", result)
+	}
+
+	sendFrame(t, conn, protocol.TypeTyping, "4", protocol.Typing{Typing: true})
+	var typing protocol.TypingEvent
+	readEvent(t, conn, protocol.TypeTyping, &typing)
+	if typing.Username != "testuser" || !typing.Typing {
+		t.Errorf("unexpected typing event: %+v", typing)
+	}
+}
+
+func TestServeWebSocket_HandshakeAuthentication(t *testing.T) {
+	server := httptest.NewServer(ServeWebSocket(chat.NewHub(storage.NewMemoryMessageStore()), chat.DefaultClientConfig(), nil, false))
+	defer server.Close()
 	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/"
-	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
-	if err != nil {
-		t.Fatalf("failed to connect to WebSocket server: %v", err)
+	token := GenerateToken("testuser")
+
+	testCases := []struct {
+		name         string
+		subprotocols []string
+		header       http.Header
+		refused      bool
+	}{
+		{"authorization header", nil, http.Header{"Authorization": {"Bearer " + token}}, false},
+		{"subprotocol", []string{protocol.TokenSubprotocolPrefix + token}, nil, false},
+		{"cookie", nil, http.Header{"Cookie": {tokenCookie + "=" + token}}, false},
+		{"cookie from this site", nil, http.Header{"Cookie": {tokenCookie + "=" + token}, "Origin": {server.URL}}, false},
+		{"cookie from another site", nil, http.Header{"Cookie": {tokenCookie + "=" + token}, "Origin": {"https://chat.example.com"}}, true},
+		{"header from another site", nil, http.Header{"Authorization": {"Bearer " + token}, "Origin": {"https://chat.example.com"}}, false},
+		{"missing token", nil, nil, true},
+		{"invalid token", nil, http.Header{"Authorization": {"Bearer invalid-token"}}, true},
 	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: append([]string{protocol.Version1}, tc.subprotocols...)}
+			conn, _, err := dialer.Dial(u, tc.header)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+
+			// The token subprotocol is never selected, only the protocol version
+			if conn.Subprotocol() != protocol.Version1 {
+				t.Errorf("unexpected negotiated protocol: got %v want %v", conn.Subprotocol(), protocol.Version1)
+			}
+
+			// Refused connections get an error frame the page can read, then are closed
+			var errorEvent protocol.ErrorEvent
+			if !tc.refused {
+				readEvent(t, conn, protocol.TypePresence, &protocol.PresenceEvent{})
+				return
+			}
+			readEvent(t, conn, protocol.TypeError, &errorEvent)
+			if errorEvent.Code != protocol.ErrInvalidToken {
+				t.Errorf("unexpected error event: %+v", errorEvent)
+			}
+			if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("expected policy violation close, got %v", err)
+			}
+		})
+	}
+}
+
+func TestServeWebSocket_IdentityBoundToConnection(t *testing.T) {
+	server := httptest.NewServer(ServeWebSocket(chat.NewHub(storage.NewMemoryMessageStore()), chat.DefaultClientConfig(), nil, false))
+	defer server.Close()
+
+	conn := dialRoom(t, server.URL, chat.DefaultRoom, "testuser")
 	defer conn.Close()
 
-	// Wait for a short time to allow the HandleMessages goroutine to process the message
-	time.Sleep(time.Millisecond * 100)
+	// A token smuggled into a frame is ignored
+	frame := map[string]interface{}{
+		"type": protocol.TypeMessage,
+		"data": map[string]string{"content": "Hello", "token": GenerateToken("someoneelse"), "username": "someoneelse"},
+	}
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatalf("failed to write frame to WebSocket connection: %v", err)
+	}
+
+	var received models.Message
+	envelope := readEvent(t, conn, protocol.TypeMessage, &received)
+	if received.Username != "testuser" {
+		t.Errorf("unexpected username: got %v want %v", received.Username, "testuser")
+	}
+	if strings.Contains(string(envelope.Data), "token") {
+		t.Errorf("broadcast payload must not carry a token: %s", envelope.Data)
+	}
+}
+
+func TestServeWebSocket_UnsupportedProtocol(t *testing.T) {
+	server := httptest.NewServer(ServeWebSocket(chat.NewHub(storage.NewMemoryMessageStore()), chat.DefaultClientConfig(), nil, false))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/"
+	_, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		t.Fatal("expected dial without a protocol version to fail")
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code: got %v want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestServeWebSocket_UnknownRoom(t *testing.T) {
+	server := httptest.NewServer(ServeWebSocket(chat.NewHub(storage.NewMemoryMessageStore()), chat.DefaultClientConfig(), nil, false))
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.Version1}}
+	header := http.Header{"Authorization": {"Bearer " + GenerateToken("testuser")}}
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/?room=missing"
+	_, resp, err := dialer.Dial(u, header)
+	if err == nil {
+		t.Fatal("expected dial to an unknown room to fail")
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code: got %v want %v", resp.StatusCode, http.StatusNotFound)
+	}
 }
 
 func TestServeChat_Unauthenticated(t *testing.T) {
 	mockToken := "invalid-token"
 	mockTemplate := template.New("")
-	handler := ServeChat(mockTemplate)
+	handler := ServeChat(mockTemplate, chat.NewHub(storage.NewMemoryMessageStore()))
 
 	req, err := http.NewRequest("GET", "/chat?token="+mockToken, nil)
 	if err != nil {
@@ -135,15 +339,225 @@ func TestServeChat_Unauthenticated(t *testing.T) {
 	}
 }
 
-func TestCallBotAPI(t *testing.T) {
-	// Create a mock server to simulate the external API
-	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "Mock API response")
-	}))
-	defer mockServer.Close()
+func TestServeChat_Token(t *testing.T) {
+	mockTemplate := template.Must(template.New("chat.html").Parse(`{{ .Room }}: {{ range .Members }}{{ . }} {{ end }}`))
+	handler := ServeChat(mockTemplate, chat.NewHub(storage.NewMemoryMessageStore()))
+	token := GenerateToken("testuser")
+
+	// The token is enough, no other cookie is needed
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/chat?token="+token, nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
 
-	// Replace the URL with the mock server URL
-	mockURL := mockServer.URL + "/stock-quote?stock_code=TEST"
-	callBotAPI(mockURL)
+	if err := tokens.Revoke(token); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/chat?token="+token, nil))
+	if location := rr.Header().Get("Location"); location != "/login" {
+		t.Errorf("expected a revoked token to go back to login, got %v", location)
+	}
+}
+
+func TestCreateRoom(t *testing.T) {
+	hub := chat.NewHub(storage.NewMemoryMessageStore())
+	handler := CreateRoom(hub)
+	token := GenerateToken("testuser")
+
+	testCases := []struct {
+		room           string
+		expectedStatus int
+	}{
+		{"project-x", http.StatusSeeOther},
+		{"project-x", http.StatusSeeOther}, // already exists, joins it
+		{"Not A Room!", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		form := url.Values{"token": {token}, "room": {tc.room}}
+		req, err := http.NewRequest("POST", "/rooms", strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tc.expectedStatus {
+			t.Errorf("handler returned wrong status code for %q: got %v want %v", tc.room, status, tc.expectedStatus)
+		}
+	}
+
+	if rooms := hub.Rooms(); len(rooms) != 2 || rooms[0] != chat.DefaultRoom || rooms[1] != "project-x" {
+		t.Errorf("unexpected rooms: %v", rooms)
+	}
+}
+
+func TestServeWebSocket_StockCommandUnavailable(t *testing.T) {
+	// The client never connects, so requests cannot be queued for the bots
+	b := rabbitmq.New(rabbitmq.Config{URL: "amqp://localhost:5672/"})
+	server := httptest.NewServer(ServeWebSocket(chat.NewHub(storage.NewMemoryMessageStore()), chat.DefaultClientConfig(), b, false))
+	defer server.Close()
+
+	conn := dialRoom(t, server.URL, chat.DefaultRoom, "testuser")
+	defer conn.Close()
+
+	sendFrame(t, conn, protocol.TypeMessage, "1", protocol.SendMessage{Content: "/stock=AAPL.US"})
+	var errorEvent protocol.ErrorEvent
+	envelope := readEvent(t, conn, protocol.TypeError, &errorEvent)
+	if envelope.ID != "1" || errorEvent.Code != protocol.ErrInternal {
+		t.Errorf("unexpected error event: %+v %+v", envelope, errorEvent)
+	}
+}
+
+func TestServeWebSocket_StockCommand(t *testing.T) {
+	hub := chat.NewHub(storage.NewMemoryMessageStore())
+	// The server and the bot share an in-process broker
+	b := broker.NewMemory()
+	server := httptest.NewServer(ServeWebSocket(hub, chat.DefaultClientConfig(), b, false))
+	defer server.Close()
+	ConsumeStockQuotes(hub, b)
+	bot.Serve(context.Background(), b, bot.FixtureProvider{"AAPL.US": {Symbol: "AAPL.US", Close: 93.42}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn := dialRoom(t, server.URL, chat.DefaultRoom, "testuser")
+	defer conn.Close()
+
+	sendFrame(t, conn, protocol.TypeMessage, "1", protocol.SendMessage{Content: "/stock=AAPL.US"})
+	var message models.Message
+	readEvent(t, conn, protocol.TypeMessage, &message)
+	if message.Username != "Bot" || message.Content != "AAPL.US quote is $93.42 per share" {
+		t.Errorf("unexpected message: %+v", message)
+	}
+
+	// Failures are only answered to the user who asked, with their category
+	sendFrame(t, conn, protocol.TypeMessage, "2", protocol.SendMessage{Content: "/stock=XYZ.US"})
+	var result protocol.CommandResultEvent
+	readEvent(t, conn, protocol.TypeCommandResult, &result)
+	expected := protocol.CommandResultEvent{
+		Command: "/stock",
+		Code:    string(stock.ErrorUnknownSymbol),
+		Content: "Sorry, I could not find a stock called XYZ.US. Stock codes look like AAPL.US.",
+	}
+	if result != expected {
+		t.Errorf("unexpected result: got %+v want %+v", result, expected)
+	}
+
+	general, _ := hub.Room(chat.DefaultRoom)
+	if history := general.History(); len(history) != 1 || history[0].Content != message.Content {
+		t.Errorf("expected only the quote in the history, got %+v", history)
+	}
+}
+
+func TestServeWebSocket_PrivateStockReplies(t *testing.T) {
+	b := broker.NewMemory()
+	server := httptest.NewServer(ServeWebSocket(chat.NewHub(storage.NewMemoryMessageStore()), chat.DefaultClientConfig(), b, true))
+	defer server.Close()
+
+	requests := make(chan stock.Request, 1)
+	b.Subscribe(stock.RequestQueue.Name, func(d broker.Delivery) error {
+		request, err := stock.DecodeRequest(d)
+		if err != nil {
+			return err
+		}
+		requests <- request
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn := dialRoom(t, server.URL, chat.DefaultRoom, "testuser")
+	defer conn.Close()
+
+	sendFrame(t, conn, protocol.TypeMessage, "1", protocol.SendMessage{Content: "/stock=AAPL.US"})
+	select {
+	case request := <-requests:
+		if !request.Private || request.Username != "testuser" || request.StockCode != "AAPL.US" {
+			t.Errorf("unexpected request: %+v", request)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the stock request")
+	}
+}
+
+func TestDeliverStockReply(t *testing.T) {
+	hub := chat.NewHub(storage.NewMemoryMessageStore())
+	project, _ := hub.CreateRoom("project-x")
+	general, _ := hub.Room(chat.DefaultRoom)
+
+	reply := stock.NewRequest("testuser", "project-x", "AAPL.US").Reply("AAPL.US quote is $93.42 per share")
+	msg, err := reply.Message()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := deliverStockReply(hub, broker.Delivery{Message: msg}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The reply only goes to the room it was asked in
+	history := project.History()
+	if len(history) != 1 || history[0].Username != "Bot" || history[0].Content != reply.Content {
+		t.Errorf("unexpected history: %+v", history)
+	}
+	if len(general.History()) != 0 {
+		t.Errorf("unexpected messages in general: %+v", general.History())
+	}
+
+	// Private replies are not recorded in the room history
+	private := reply
+	private.Private = true
+	msg, _ = private.Message()
+	if err := deliverStockReply(hub, broker.Delivery{Message: msg}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(project.History()) != 1 {
+		t.Errorf("unexpected history after private reply: %+v", project.History())
+	}
+
+	// Failures are not recorded in the room history either
+	failure := stock.NewRequest("testuser", "project-x", "XYZ.US").Fail(stock.ErrorUnknownSymbol, "Sorry, I could not find a stock called XYZ.US.")
+	msg, _ = failure.Message()
+	if err := deliverStockReply(hub, broker.Delivery{Message: msg}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(project.History()) != 1 {
+		t.Errorf("unexpected history after failure: %+v", project.History())
+	}
+
+	unknownRoom := reply
+	unknownRoom.Room = "missing"
+	msg, _ = unknownRoom.Message()
+	for _, body := range [][]byte{nil, []byte("AAPL.US quote is $93.42 per share"), []byte(`{"room":"project-x"}`), msg.Body} {
+		if err := deliverStockReply(hub, broker.Delivery{Message: broker.Message{Body: body}}); !errors.Is(err, broker.ErrPoison) {
+			t.Errorf("expected ErrPoison for %q, got %v", body, err)
+		}
+	}
+
+	// Quotes arriving during shutdown fail so they are requeued rather than lost
+	hub.Shutdown(context.Background(), "server shutting down")
+	msg, _ = reply.Message()
+	if err := deliverStockReply(hub, broker.Delivery{Message: msg}); !errors.Is(err, chat.ErrRoomClosed) {
+		t.Errorf("expected ErrRoomClosed, got %v", err)
+	}
 }
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+	"github.com/andrerussowsky/chat-app/internal/chat"
+)
+
+// RelayTopic is the topic the chat servers share their messages on
+const RelayTopic = "chat_messages"
+
+// RelayMessages shares the messages of hub's rooms with the other chat servers
+// connected to b and delivers theirs to the local clients, so that several
+// servers can run behind a load balancer. Local messages are published until
+// ctx is done.
+func RelayMessages(ctx context.Context, hub *chat.Hub, b broker.Broker) {
+	b.SubscribeTopic(RelayTopic, func(d broker.Delivery) error {
+		return relayEvent(hub, d)
+	})
+
+	outbox := hub.StartRelay()
+	go func() {
+		for {
+			select {
+			case e := <-outbox:
+				publishRelayEvent(b, e)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// publishRelayEvent publishes an event of the local rooms for the other chat
+// servers, it is dropped when the broker cannot take it
+func publishRelayEvent(b broker.Broker, e chat.RelayEvent) {
+	body, err := json.Marshal(e)
+	if err == nil {
+		err = b.PublishTopic(RelayTopic, broker.Message{ContentType: "application/json", CorrelationID: e.ID, Body: body})
+	}
+	if err != nil {
+		log.Printf("Failed to relay %s event %s of room %s: %v", e.Type, e.ID, e.Room, err)
+	}
+}
+
+// relayEvent delivers an event of another chat server to the local clients
+func relayEvent(hub *chat.Hub, d broker.Delivery) error {
+	var e chat.RelayEvent
+	if err := json.Unmarshal(d.Body, &e); err != nil {
+		return fmt.Errorf("%w: invalid relay event: %v", broker.ErrPoison, err)
+	}
+
+	err := hub.Relay(e)
+	if errors.Is(err, chat.ErrInvalidRelayEvent) || errors.Is(err, chat.ErrInvalidRoomName) {
+		return fmt.Errorf("%w: %v", broker.ErrPoison, err)
+	}
+	return err
+}
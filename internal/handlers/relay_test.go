@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+	"github.com/andrerussowsky/chat-app/internal/chat"
+	"github.com/andrerussowsky/chat-app/internal/models"
+	"github.com/andrerussowsky/chat-app/internal/protocol"
+	"github.com/andrerussowsky/chat-app/internal/storage"
+)
+
+func TestRelayMessages(t *testing.T) {
+	// Two chat servers sharing their database and an in-process broker
+	store := storage.NewMemoryMessageStore()
+	first, second := chat.NewHub(store), chat.NewHub(store)
+	firstServer := httptest.NewServer(ServeWebSocket(first, chat.DefaultClientConfig(), nil, false))
+	defer firstServer.Close()
+	secondServer := httptest.NewServer(ServeWebSocket(second, chat.DefaultClientConfig(), nil, false))
+	defer secondServer.Close()
+
+	b := broker.NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	RelayMessages(ctx, first, b)
+	RelayMessages(ctx, second, b)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	alice := dialRoom(t, firstServer.URL, chat.DefaultRoom, "alice")
+	defer alice.Close()
+	bob := dialRoom(t, secondServer.URL, chat.DefaultRoom, "bob")
+	defer bob.Close()
+
+	sendFrame(t, alice, protocol.TypeMessage, "1", protocol.SendMessage{Content: "hi bob"})
+
+	// Each user gets the message once, from their own server
+	var message models.Message
+	readEvent(t, bob, protocol.TypeMessage, &message)
+	if message.Username != "alice" || message.Content != "hi bob" || message.ID == 0 {
+		t.Errorf("unexpected message: %+v", message)
+	}
+	readEvent(t, alice, protocol.TypeMessage, &message)
+	if message.Content != "hi bob" {
+		t.Errorf("unexpected message: %+v", message)
+	}
+
+	sendFrame(t, bob, protocol.TypeMessage, "2", protocol.SendMessage{Content: "hi alice"})
+	readEvent(t, alice, protocol.TypeMessage, &message)
+	if message.Username != "bob" || message.Content != "hi alice" {
+		t.Errorf("expected alice not to get her own message twice, got %+v", message)
+	}
+
+	if stored, _ := store.MessagesBefore(chat.DefaultRoom, 0, 10); len(stored) != 2 {
+		t.Errorf("unexpected stored messages: %+v", stored)
+	}
+
+	// Rooms created on one server can be joined on the other
+	if _, err := first.CreateRoom("project-x"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, err := second.Room("project-x"); err != nil; _, err = second.Room("project-x") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the room to be created on the other server: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRelayEvent_Poison(t *testing.T) {
+	hub := chat.NewHub(storage.NewMemoryMessageStore())
+
+	for _, body := range []string{"", "hi", `{"type":"message","room":"general"}`, `{"id":"1","type":"room_created","room":"Not A Room"}`} {
+		if err := relayEvent(hub, broker.Delivery{Message: broker.Message{Body: []byte(body)}}); !errors.Is(err, broker.ErrPoison) {
+			t.Errorf("expected ErrPoison for %q, got %v", body, err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Package health serves the health endpoint of the chat server and the bot
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+)
+
+// healthResponse is returned by the health endpoint
+type healthResponse struct {
+	Status string `json:"status"` // "ok" or "degraded"
+	Broker string `json:"broker"` // state of the connection to the message broker
+	Error  string `json:"error,omitempty"`
+}
+
+// Serve reports whether the message broker is connected, answering 503 while it is not
+func Serve(b broker.Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := b.State()
+		response := healthResponse{Status: "ok", Broker: state.String()}
+		status := http.StatusOK
+		if state != broker.StateConnected {
+			response.Status = "degraded"
+			if err := b.Err(); err != nil {
+				response.Error = err.Error()
+			}
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,68 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+	"github.com/andrerussowsky/chat-app/internal/rabbitmq"
+)
+
+func TestServe_Disconnected(t *testing.T) {
+	rabbit := rabbitmq.New(rabbitmq.Config{URL: "amqp://localhost:5672/"})
+
+	rr := httptest.NewRecorder()
+	Serve(rabbit)(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	var response healthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.Status != "degraded" || response.Broker != "connecting" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
+
+func TestServe_Connected(t *testing.T) {
+	b := broker.NewMemory()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var rr *httptest.ResponseRecorder
+	deadline := time.Now().Add(time.Second)
+	for {
+		rr = httptest.NewRecorder()
+		Serve(b)(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rr.Code == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var response healthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.Status != "ok" || response.Broker != "connected" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+}
@@ -1,8 +1,10 @@
 package models
 
 type Message struct {
+	ID        int64  `json:"id"`
 	Username  string `json:"username"`
+	Nickname  string `json:"nickname,omitempty"` // display name chosen with /nick, if any
+	Room      string `json:"room"`
 	Content   string `json:"content"`
-	Token     string `json:"token"`
 	Timestamp string `json:"timestamp"`
 }
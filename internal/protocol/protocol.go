@@ -0,0 +1,124 @@
+// Package protocol defines the frames exchanged with chat clients over the WebSocket.
+//
+// Every frame is an Envelope whose Type tells how to decode its Data. The
+// protocol version is negotiated with the Sec-WebSocket-Protocol header when
+// connecting, a client must offer at least one of Subprotocols.
+//
+// Clients authenticate once when connecting, frames carry no credentials.
+// Browsers, which cannot set headers on WebSockets, may pass their token as an
+// extra subprotocol made of TokenSubprotocolPrefix followed by the token.
+package protocol
+
+import (
+	"encoding/json"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+)
+
+// Version1 is the first version of the protocol
+const Version1 = "chat.v1"
+
+// Subprotocols lists the supported protocol versions, preferred first
+var Subprotocols = []string{Version1}
+
+// TokenSubprotocolPrefix marks the subprotocol carrying the client token
+const TokenSubprotocolPrefix = "token."
+
+// Event types
+const (
+	TypeHistory       = "history"        // server: HistoryEvent, sent once on connect
+	TypeMessage       = "message"        // client: SendMessage, server: models.Message
+	TypeJoin          = "join"           // server: MemberEvent, a user joined the room
+	TypeLeave         = "leave"          // server: MemberEvent, a user left the room
+	TypeTyping        = "typing"         // client: Typing, server: TypingEvent
+	TypePresence      = "presence"       // server: PresenceEvent, who is in the room
+	TypeError         = "error"          // server: ErrorEvent
+	TypeAck           = "ack"            // server: AckEvent, a client frame was accepted
+	TypeCommandResult = "command_result" // server: CommandResultEvent, only sent to the issuer
+)
+
+// Error codes of ErrorEvent
+const (
+	ErrBadRequest      = "bad_request"
+	ErrUnsupportedType = "unsupported_type"
+	ErrInvalidToken    = "invalid_token"
+	ErrLoggedOut       = "logged_out"
+	ErrInternal        = "internal_error"
+)
+
+// Envelope wraps every frame. ID is chosen by the client and echoed
+// in the ack or error answering that frame.
+type Envelope struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// NewEnvelope creates an envelope of eventType carrying data
+func NewEnvelope(eventType string, data interface{}) (Envelope, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{Type: eventType, Data: raw}, nil
+}
+
+// Decode decodes the data of the envelope into v
+func (e Envelope) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// SendMessage is sent by clients to post a message
+type SendMessage struct {
+	Content string `json:"content"`
+}
+
+// Typing is sent by clients when they start or stop typing
+type Typing struct {
+	Typing bool `json:"typing"`
+}
+
+// HistoryEvent holds the recent messages of a room, oldest first
+type HistoryEvent struct {
+	Room     string           `json:"room"`
+	Messages []models.Message `json:"messages"`
+}
+
+// MemberEvent tells that a user joined or left a room
+type MemberEvent struct {
+	Room     string `json:"room"`
+	Username string `json:"username"`
+}
+
+// TypingEvent tells that a user started or stopped typing
+type TypingEvent struct {
+	Room     string `json:"room"`
+	Username string `json:"username"`
+	Typing   bool   `json:"typing"`
+}
+
+// PresenceEvent lists the users currently in a room
+type PresenceEvent struct {
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
+// ErrorEvent reports a problem with a client frame or the connection
+type ErrorEvent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// AckEvent confirms that the client frame with ID was accepted
+type AckEvent struct {
+	ID string `json:"id"`
+}
+
+// CommandResultEvent is the answer to a slash command
+type CommandResultEvent struct {
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Code    string `json:"code,omitempty"` // why the command failed, when it tells
+	Content string `json:"content"`
+}
@@ -0,0 +1,93 @@
+package rabbitmq
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// confirmations matches the confirmations of a channel in confirm mode to the
+// publishes waiting for them, by delivery tag. Its own goroutine drains the
+// confirmations, so the ones nobody waits for never block the connection.
+type confirmations struct {
+	publishMu sync.Mutex // the delivery tags follow the order of the publishes
+	published uint64     // the delivery tag of the last publish
+
+	mu      sync.Mutex
+	waiting map[uint64]chan bool // receives whether the broker took the message
+	closed  bool
+}
+
+// newConfirmations drains confirms until it is closed with its channel
+func newConfirmations(confirms <-chan amqp.Confirmation) *confirmations {
+	c := &confirmations{waiting: make(map[uint64]chan bool)}
+	go c.run(confirms)
+	return c
+}
+
+func (c *confirmations) run(confirms <-chan amqp.Confirmation) {
+	for confirmation := range confirms {
+		c.mu.Lock()
+		done := c.waiting[confirmation.DeliveryTag]
+		delete(c.waiting, confirmation.DeliveryTag)
+		c.mu.Unlock()
+
+		if done != nil {
+			done <- confirmation.Ack
+		}
+	}
+
+	// The channel closed, the publishes still waiting will never be confirmed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for tag, done := range c.waiting {
+		close(done)
+		delete(c.waiting, tag)
+	}
+}
+
+// publish publishes p on ch. With confirm it returns the delivery tag of p and
+// a channel receiving whether the broker took p, closed when ch closes first.
+func (c *confirmations) publish(ch channel, exchange, key string, p amqp.Publishing, confirm bool) (uint64, <-chan bool, error) {
+	c.publishMu.Lock()
+	defer c.publishMu.Unlock()
+
+	// Wait before publishing, the confirmation can come before Publish returns
+	tag := c.published + 1
+	var done chan bool
+	if confirm {
+		done = c.expect(tag)
+	}
+
+	if err := ch.Publish(exchange, key, false, false, p); err != nil {
+		c.forget(tag)
+		return 0, nil, err
+	}
+	c.published = tag
+	return tag, done, nil
+}
+
+// expect returns the channel receiving the confirmation of tag
+func (c *confirmations) expect(tag uint64) chan bool {
+	done := make(chan bool, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		close(done)
+	} else {
+		c.waiting[tag] = done
+	}
+	return done
+}
+
+// forget stops waiting for the confirmation of tag
+func (c *confirmations) forget(tag uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.waiting, tag)
+}
@@ -0,0 +1,454 @@
+// Package rabbitmq implements broker.Broker over a RabbitMQ connection that
+// survives broker restarts.
+//
+// A Client declares its queues and subscribes its consumers again every time
+// it reconnects, so callers register them once before calling Run.
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+)
+
+// ErrNotConfirmed is returned when the broker did not confirm a published message
+var ErrNotConfirmed = errors.New("message was not confirmed by RabbitMQ")
+
+// confirmTimeout is how long Publish waits for the broker to confirm a message
+const confirmTimeout = 5 * time.Second
+
+// attemptsHeader counts the failed attempts at handling a message. RabbitMQ
+// also marks the messages it requeues after a connection broke as
+// redelivered, so requeued messages are published again with this header.
+const attemptsHeader = "x-attempts"
+
+// Config configures a Client
+type Config struct {
+	URL        string
+	MinBackoff time.Duration // delay before the first reconnection attempt
+	MaxBackoff time.Duration // the delay doubles after every failed attempt up to this
+	Prefetch   int           // unacknowledged deliveries a consumer may hold, 10 by default
+	Confirm    bool          // wait for the broker to confirm every queued message
+}
+
+// consumer is a subscription made again on every connection
+type consumer struct {
+	queue  string // or the fanout exchange of a topic
+	topic  bool
+	handle broker.Handler
+}
+
+// Client is a RabbitMQ connection that reconnects with exponential backoff
+type Client struct {
+	config Config
+	dial   func(url string) (connection, error)
+	state  atomic.Int32
+
+	mu        sync.Mutex
+	queues    []broker.Queue
+	consumers []consumer
+	channel   channel         // nil while disconnected
+	confirms  *confirmations  // of channel, nil without Config.Confirm
+	exchanges map[string]bool // topic exchanges declared on channel
+	lastErr   error
+}
+
+// New creates a client, it connects once Run is called
+func New(config Config) *Client {
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 500 * time.Millisecond
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = config.MinBackoff
+	}
+	if config.Prefetch <= 0 {
+		config.Prefetch = 10
+	}
+
+	return &Client{config: config, dial: dial}
+}
+
+var _ broker.Broker = (*Client)(nil)
+
+// Declare declares queue on every connection
+func (c *Client) Declare(queue broker.Queue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.queues = append(c.queues, queue)
+}
+
+// Subscribe subscribes handle to queue on every connection
+func (c *Client) Subscribe(queue string, handle broker.Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.consumers = append(c.consumers, consumer{queue: queue, handle: handle})
+}
+
+// SubscribeTopic subscribes handle to topic on every connection, through a
+// queue of its own bound to the topic's fanout exchange. The queue is deleted
+// when the connection closes.
+func (c *Client) SubscribeTopic(topic string, handle broker.Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.consumers = append(c.consumers, consumer{queue: topic, topic: true, handle: handle})
+}
+
+// Publish publishes msg as a persistent message with the current connection.
+// With Config.Confirm it returns once the broker confirmed the message, or
+// ErrNotConfirmed.
+func (c *Client) Publish(queue string, msg broker.Message) error {
+	return c.publish("", queue, publishing(msg, amqp.Persistent), true)
+}
+
+// PublishTopic publishes msg to the fanout exchange of topic, declaring it
+// first if needed. Topic messages are transient, it does not wait for their
+// confirmation.
+func (c *Client) PublishTopic(topic string, msg broker.Message) error {
+	c.mu.Lock()
+	ch, declared := c.channel, c.exchanges[topic]
+	c.mu.Unlock()
+
+	if ch == nil {
+		return broker.ErrNotConnected
+	}
+	if !declared {
+		if err := declareTopic(ch, topic); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		if c.channel == ch {
+			c.exchanges[topic] = true
+		}
+		c.mu.Unlock()
+	}
+
+	// Topic messages only live in the queues of the connected subscribers
+	return c.publish(topic, "", publishing(msg, amqp.Transient), false)
+}
+
+// publishing converts msg to an AMQP publishing
+func publishing(msg broker.Message, deliveryMode uint8) amqp.Publishing {
+	return amqp.Publishing{
+		ContentType:   msg.ContentType,
+		DeliveryMode:  deliveryMode,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		Body:          msg.Body,
+	}
+}
+
+// publish publishes p with the current connection. With confirm and
+// Config.Confirm it waits for the broker to confirm p, the other publishes
+// go on meanwhile.
+func (c *Client) publish(exchange, key string, p amqp.Publishing, confirm bool) error {
+	c.mu.Lock()
+	ch, confirms := c.channel, c.confirms
+	c.mu.Unlock()
+
+	if ch == nil {
+		return broker.ErrNotConnected
+	}
+	if confirms == nil {
+		return ch.Publish(exchange, key, false, false, p)
+	}
+
+	tag, done, err := confirms.publish(ch, exchange, key, p, confirm)
+	if err != nil || done == nil {
+		return err
+	}
+
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+	select {
+	case ack, ok := <-done:
+		if !ok || !ack {
+			return ErrNotConfirmed
+		}
+		return nil
+	case <-timer.C:
+		confirms.forget(tag)
+		return ErrNotConfirmed
+	}
+}
+
+// retry publishes d again on queue with one more failed attempt recorded,
+// then acknowledges it. When the message cannot be published it is requeued
+// as is.
+func (c *Client) retry(d amqp.Delivery, queue string) error {
+	p := amqp.Publishing{
+		Headers:       amqp.Table{},
+		ContentType:   d.ContentType,
+		DeliveryMode:  d.DeliveryMode,
+		CorrelationId: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		Body:          d.Body,
+	}
+	for key, value := range d.Headers {
+		p.Headers[key] = value
+	}
+	p.Headers[attemptsHeader] = int32(attempts(d) + 1)
+
+	if err := c.publish("", queue, p, true); err != nil {
+		log.Printf("Failed to requeue message from %s with its attempts: %v", queue, err)
+		return d.Nack(false, true)
+	}
+	return d.Ack(false)
+}
+
+// Ack settles d, acknowledging or rejecting it on the channel it came from
+func (c *Client) Ack(d broker.Delivery, err error) {
+	broker.Settle(d, err)
+}
+
+func (c *Client) State() broker.State {
+	return broker.State(c.state.Load())
+}
+
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastErr
+}
+
+// Run connects to the broker and keeps reconnecting until ctx is done
+func (c *Client) Run(ctx context.Context) {
+	defer c.state.Store(int32(broker.StateClosed))
+
+	attempt := 0
+	for {
+		connected, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.mu.Lock()
+		c.lastErr = err
+		c.mu.Unlock()
+		c.state.Store(int32(broker.StateReconnecting))
+
+		if connected {
+			attempt = 0
+		}
+		delay := backoff(attempt, c.config.MinBackoff, c.config.MaxBackoff)
+		attempt++
+		log.Printf("RabbitMQ connection failed: %v, reconnecting in %v", err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// session connects, declares the queues and starts the consumers, then waits
+// for the connection to break or ctx to be done
+func (c *Client) session(ctx context.Context) (connected bool, err error) {
+	conn, err := c.dial(c.config.URL)
+	if err != nil {
+		return false, err
+	}
+
+	// Closing the connection ends the deliveries, which the consumers wait for
+	var wg sync.WaitGroup
+	defer func() {
+		conn.Close()
+		wg.Wait()
+	}()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	// A channel exception closes the channel and leaves the connection up
+	channelClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	c.mu.Lock()
+	queues := append([]broker.Queue(nil), c.queues...)
+	consumers := append([]consumer(nil), c.consumers...)
+	c.mu.Unlock()
+
+	for _, q := range queues {
+		if err := declare(ch, q); err != nil {
+			return false, err
+		}
+	}
+
+	var confirms *confirmations
+	if c.config.Confirm {
+		if err := ch.Confirm(false); err != nil {
+			return false, err
+		}
+		confirms = newConfirmations(ch.NotifyPublish(make(chan amqp.Confirmation, 1)))
+	}
+	if err := ch.Qos(c.config.Prefetch, 0, false); err != nil {
+		return false, err
+	}
+
+	exchanges := make(map[string]bool)
+	for _, sub := range consumers {
+		queue := sub.queue
+		if sub.topic {
+			if queue, err = subscribeTopic(ch, sub.queue); err != nil {
+				return false, err
+			}
+			exchanges[sub.queue] = true
+		}
+
+		deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+		if err != nil {
+			return false, err
+		}
+
+		wg.Add(1)
+		go func(sub consumer, queue string) {
+			defer wg.Done()
+			for d := range deliveries {
+				d := c.delivery(d, sub.queue, queue)
+				c.Ack(d, sub.handle(d))
+			}
+		}(sub, queue)
+	}
+
+	c.mu.Lock()
+	c.channel = ch
+	c.confirms = confirms
+	c.exchanges = exchanges
+	c.mu.Unlock()
+	c.state.Store(int32(broker.StateConnected))
+	log.Printf("Connected to RabbitMQ")
+
+	defer func() {
+		c.mu.Lock()
+		c.channel = nil
+		c.confirms = nil
+		c.exchanges = nil
+		c.mu.Unlock()
+	}()
+
+	select {
+	case amqpErr, ok := <-closed:
+		if !ok || amqpErr == nil {
+			return true, errors.New("connection closed")
+		}
+		return true, amqpErr
+	case amqpErr, ok := <-channelClosed:
+		if !ok || amqpErr == nil {
+			return true, errors.New("channel closed")
+		}
+		return true, amqpErr
+	case <-ctx.Done():
+		return true, nil
+	}
+}
+
+// declare declares q, after its dead-letter queue if it has one
+func declare(ch channel, q broker.Queue) error {
+	var args amqp.Table
+	if q.DeadLetter != "" {
+		if _, err := ch.QueueDeclare(q.DeadLetter, true, false, false, false, nil); err != nil {
+			return err
+		}
+		args = deadLetterArgs(q.DeadLetter)
+	}
+
+	_, err := ch.QueueDeclare(q.Name, q.Durable, false, false, false, args)
+	return err
+}
+
+// declareTopic declares the fanout exchange of topic
+func declareTopic(ch channel, topic string) error {
+	return ch.ExchangeDeclare(topic, amqp.ExchangeFanout, true, false, false, false, nil)
+}
+
+// subscribeTopic declares a queue receiving the messages of topic until the
+// connection closes, and returns the name the broker gave it
+func subscribeTopic(ch channel, topic string) (string, error) {
+	if err := declareTopic(ch, topic); err != nil {
+		return "", err
+	}
+
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return "", err
+	}
+	return q.Name, ch.QueueBind(q.Name, "", topic, false, nil)
+}
+
+// deadLetterArgs routes the rejected messages of a queue to deadLetter
+func deadLetterArgs(deadLetter string) amqp.Table {
+	return amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": deadLetter,
+	}
+}
+
+// delivery converts a delivery of queue to a broker.Delivery of name, the
+// topic for the queues of topic subscriptions
+func (c *Client) delivery(d amqp.Delivery, name, queue string) broker.Delivery {
+	return broker.Delivery{
+		Message: broker.Message{
+			ContentType:   d.ContentType,
+			CorrelationID: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			Body:          d.Body,
+		},
+		Queue:        name,
+		Attempts:     attempts(d),
+		Acknowledger: acknowledger{client: c, delivery: d, queue: queue},
+	}
+}
+
+// attempts returns the failed attempts recorded on d
+func attempts(d amqp.Delivery) int {
+	switch n := d.Headers[attemptsHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	default:
+		return 0
+	}
+}
+
+// acknowledger settles an AMQP delivery of queue on the channel it came from
+type acknowledger struct {
+	client   *Client
+	delivery amqp.Delivery
+	queue    string
+}
+
+func (a acknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+func (a acknowledger) Nack(requeue bool) error {
+	if requeue {
+		return a.client.retry(a.delivery, a.queue)
+	}
+	return a.delivery.Nack(false, false)
+}
+
+// backoff returns the delay before reconnection attempt, starting at 0
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,556 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+)
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{100, time.Second},
+	}
+
+	for _, tc := range testCases {
+		if got := backoff(tc.attempt, 100*time.Millisecond, time.Second); got != tc.expected {
+			t.Errorf("backoff(%d): got %v want %v", tc.attempt, got, tc.expected)
+		}
+	}
+}
+
+func TestClient_Reconnects(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/", MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond})
+	dialErr := errors.New("connection refused")
+	var attempts atomic.Int32
+	client.dial = func(url string) (connection, error) {
+		attempts.Add(1)
+		return nil, dialErr
+	}
+
+	if state := client.State(); state != broker.StateConnecting {
+		t.Errorf("unexpected state before Run: got %v want %v", state, broker.StateConnecting)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for attempts.Load() < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the client to keep retrying, got %d attempts", attempts.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if state := client.State(); state != broker.StateReconnecting {
+		t.Errorf("unexpected state: got %v want %v", state, broker.StateReconnecting)
+	}
+	if err := client.Err(); !errors.Is(err, dialErr) {
+		t.Errorf("unexpected error: got %v want %v", err, dialErr)
+	}
+	if err := client.Publish("stock_quotes", broker.Message{}); !errors.Is(err, broker.ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return once the context is done")
+	}
+	if state := client.State(); state != broker.StateClosed {
+		t.Errorf("unexpected state after Run: got %v want %v", state, broker.StateClosed)
+	}
+}
+
+// recorder records how an AMQP delivery was settled
+type recorder struct {
+	acked    bool
+	nacked   bool
+	requeued bool
+}
+
+func (a *recorder) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *recorder) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked = true
+	a.requeued = requeue
+	return nil
+}
+
+func (a *recorder) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestClient_Ack(t *testing.T) {
+	failure := errors.New("hub is shutting down")
+
+	testCases := []struct {
+		name        string
+		err         error
+		redelivered bool
+		headers     amqp.Table
+		expected    recorder
+	}{
+		{"handled", nil, false, nil, recorder{acked: true}},
+		{"first failure is requeued", failure, false, nil, recorder{nacked: true, requeued: true}},
+		{"redelivered after a reconnect is requeued", failure, true, nil, recorder{nacked: true, requeued: true}},
+		{"second failure is dead-lettered", failure, true, amqp.Table{attemptsHeader: int32(1)}, recorder{nacked: true}},
+		{"poison is dead-lettered", fmt.Errorf("%w: empty quote", broker.ErrPoison), false, nil, recorder{nacked: true}},
+	}
+
+	// Disconnected, the requeued deliveries cannot be published again with
+	// their attempts and are requeued as is
+	client := New(Config{URL: "amqp://localhost:5672/"})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ack := &recorder{}
+			d := amqp.Delivery{Acknowledger: ack, Redelivered: tc.redelivered, Headers: tc.headers}
+			client.Ack(client.delivery(d, "stock_quotes", "stock_quotes"), tc.err)
+
+			if *ack != tc.expected {
+				t.Errorf("unexpected settlement: got %+v want %+v", *ack, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/"})
+	d := client.delivery(amqp.Delivery{
+		Headers:       amqp.Table{attemptsHeader: int32(1)},
+		ContentType:   "application/json",
+		CorrelationId: "abc",
+		ReplyTo:       "stock_quotes",
+		Redelivered:   true,
+		Body:          []byte(`{}`),
+	}, "stock_requests", "stock_requests")
+
+	expected := broker.Message{ContentType: "application/json", CorrelationID: "abc", ReplyTo: "stock_quotes", Body: []byte(`{}`)}
+	if d.ContentType != expected.ContentType || d.CorrelationID != expected.CorrelationID || d.ReplyTo != expected.ReplyTo || string(d.Body) != string(expected.Body) {
+		t.Errorf("unexpected message: got %+v want %+v", d.Message, expected)
+	}
+	if d.Queue != "stock_requests" || d.Attempts != 1 {
+		t.Errorf("unexpected delivery: %+v", d)
+	}
+}
+
+// fakeConnection is a connection to no server, its channel delivers what
+// tests push on it
+type fakeConnection struct {
+	channel *fakeChannel
+
+	mu       sync.Mutex
+	closed   bool
+	notifies []chan *amqp.Error
+}
+
+func newFakeConnection() *fakeConnection {
+	return &fakeConnection{channel: &fakeChannel{}}
+}
+
+func (c *fakeConnection) Channel() (channel, error) {
+	return c.channel, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.notifies = append(c.notifies, receiver)
+	return receiver
+}
+
+// Close closes the channel and the connection like amqp does: deliveries
+// end and the close notifications are closed without an error
+func (c *fakeConnection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closed = true
+	c.channel.close(nil)
+	for _, receiver := range c.notifies {
+		close(receiver)
+	}
+	return nil
+}
+
+// fakeChannel is the channel of a fakeConnection
+type fakeChannel struct {
+	consumeErr    error // returned by the second Consume
+	confirmByHand bool  // leave the confirmations to confirm
+
+	mu         sync.Mutex
+	closed     bool
+	deliveries []chan amqp.Delivery
+	notifies   []chan *amqp.Error
+	confirms   chan amqp.Confirmation
+	tag        uint64 // of the last publish
+	published  []fakePublishing
+}
+
+// fakePublishing is a message published on a fakeChannel
+type fakePublishing struct {
+	key string
+	amqp.Publishing
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if name == "" {
+		name = "amq.gen-test"
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.confirms = confirm
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.notifies = append(ch.notifies, receiver)
+	return receiver
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if len(ch.deliveries) == 1 && ch.consumeErr != nil {
+		return nil, ch.consumeErr
+	}
+	deliveries := make(chan amqp.Delivery)
+	ch.deliveries = append(ch.deliveries, deliveries)
+	return deliveries, nil
+}
+
+// Publish records msg, and acknowledges it in confirm mode
+func (ch *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.published = append(ch.published, fakePublishing{key: key, Publishing: msg})
+	ch.tag++
+	if ch.confirms != nil && !ch.confirmByHand {
+		ch.confirms <- amqp.Confirmation{DeliveryTag: ch.tag, Ack: true}
+	}
+	return nil
+}
+
+// confirm sends the confirmation of the publish with the given delivery tag
+func (ch *fakeChannel) confirm(tag uint64, ack bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: ack}
+}
+
+// publishes returns the number of messages published on the channel
+func (ch *fakeChannel) publishes() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return len(ch.published)
+}
+
+// deliver pushes d to the consumer of the channel
+func (ch *fakeChannel) deliver(d amqp.Delivery) {
+	ch.mu.Lock()
+	deliveries := ch.deliveries[0]
+	ch.mu.Unlock()
+
+	deliveries <- d
+}
+
+// close closes the channel, with err for a channel exception
+func (ch *fakeChannel) close(err *amqp.Error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	for _, deliveries := range ch.deliveries {
+		close(deliveries)
+	}
+	for _, receiver := range ch.notifies {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+	if ch.confirms != nil {
+		close(ch.confirms)
+	}
+}
+
+// runClient runs client until the returned function is called, which fails
+// the test unless Run returns promptly
+func runClient(t *testing.T, client *Client) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+
+	return func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected Run to return once the context is done")
+		}
+	}
+}
+
+// waitForState waits until client is in state
+func waitForState(t *testing.T, client *Client, state broker.State) {
+	deadline := time.Now().Add(time.Second)
+	for client.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for state %v, got %v", state, client.State())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClient_RunStopsConsumers(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/"})
+	conn := newFakeConnection()
+	client.dial = func(url string) (connection, error) {
+		return conn, nil
+	}
+	client.Declare(broker.Queue{Name: "stock_quotes", Durable: true})
+	client.Subscribe("stock_quotes", func(broker.Delivery) error { return nil })
+	client.SubscribeTopic("chat_messages", func(broker.Delivery) error { return nil })
+
+	stop := runClient(t, client)
+	waitForState(t, client, broker.StateConnected)
+	stop()
+
+	if !conn.closed {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestClient_ReconnectsAfterSubscribeFailure(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/", MinBackoff: time.Millisecond})
+	var dials atomic.Int32
+	client.dial = func(url string) (connection, error) {
+		conn := newFakeConnection()
+		if dials.Add(1) == 1 {
+			conn.channel.consumeErr = errors.New("no queue 'stock_requests'")
+		}
+		return conn, nil
+	}
+	client.Subscribe("stock_quotes", func(broker.Delivery) error { return nil })
+	client.Subscribe("stock_requests", func(broker.Delivery) error { return nil })
+
+	stop := runClient(t, client)
+	defer stop()
+	waitForState(t, client, broker.StateConnected)
+
+	if dials.Load() != 2 {
+		t.Errorf("unexpected dials: got %d want 2", dials.Load())
+	}
+}
+
+func TestClient_ReconnectsAfterChannelException(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/", MinBackoff: time.Hour})
+	conn := newFakeConnection()
+	client.dial = func(url string) (connection, error) {
+		return conn, nil
+	}
+	client.Subscribe("stock_quotes", func(broker.Delivery) error { return nil })
+
+	stop := runClient(t, client)
+	defer stop()
+	waitForState(t, client, broker.StateConnected)
+
+	conn.channel.close(&amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - unknown delivery tag 1"})
+	waitForState(t, client, broker.StateReconnecting)
+
+	var amqpErr *amqp.Error
+	if err := client.Err(); !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := client.Publish("stock_quotes", broker.Message{}); !errors.Is(err, broker.ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestClient_RetryRecordsAttempts(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/"})
+	conn := newFakeConnection()
+	client.dial = func(url string) (connection, error) {
+		return conn, nil
+	}
+	client.Subscribe("stock_quotes", func(broker.Delivery) error {
+		return errors.New("hub is shutting down")
+	})
+
+	stop := runClient(t, client)
+	defer stop()
+	waitForState(t, client, broker.StateConnected)
+
+	ack := &recorder{}
+	conn.channel.deliver(amqp.Delivery{
+		Acknowledger:  ack,
+		Headers:       amqp.Table{"x-trace": "abc"},
+		CorrelationId: "abc",
+		Redelivered:   true,
+		Body:          []byte(`{}`),
+	})
+	conn.channel.deliver(amqp.Delivery{Acknowledger: &recorder{}}) // handled once the first one was
+
+	conn.channel.mu.Lock()
+	defer conn.channel.mu.Unlock()
+	if len(conn.channel.published) == 0 {
+		t.Fatal("expected the delivery to be published again")
+	}
+	retry := conn.channel.published[0]
+	if retry.key != "stock_quotes" || retry.CorrelationId != "abc" || retry.Headers[attemptsHeader] != int32(1) || retry.Headers["x-trace"] != "abc" {
+		t.Errorf("unexpected retry: %+v", retry)
+	}
+	if *ack != (recorder{acked: true}) {
+		t.Errorf("expected the delivery to be acknowledged once published again, got %+v", *ack)
+	}
+}
+
+func TestClient_PublishWaitsForItsConfirmation(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/", Confirm: true})
+	conn := newFakeConnection()
+	conn.channel.confirmByHand = true
+	client.dial = func(url string) (connection, error) {
+		return conn, nil
+	}
+
+	stop := runClient(t, client)
+	defer stop()
+	waitForState(t, client, broker.StateConnected)
+
+	publish := func() <-chan error {
+		published := conn.channel.publishes()
+		result := make(chan error, 1)
+		go func() {
+			result <- client.Publish("stock_quotes", broker.Message{Body: []byte(`{}`)})
+		}()
+		for conn.channel.publishes() == published {
+			time.Sleep(time.Millisecond)
+		}
+		return result
+	}
+	first := publish()
+	second := publish()
+
+	// Topic messages do not wait for their confirmation
+	if err := client.PublishTopic("chat_messages", broker.Message{Body: []byte(`{}`)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.channel.confirm(3, true)
+
+	// The second publish does not wait behind the first one
+	conn.channel.confirm(2, true)
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the second publish to return once confirmed")
+	}
+
+	conn.channel.confirm(1, false)
+	select {
+	case err := <-first:
+		if !errors.Is(err, ErrNotConfirmed) {
+			t.Errorf("expected ErrNotConfirmed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the first publish to return once rejected")
+	}
+}
+
+func TestClient_PublishNotConfirmedWhenChannelCloses(t *testing.T) {
+	client := New(Config{URL: "amqp://localhost:5672/", Confirm: true, MinBackoff: time.Hour})
+	conn := newFakeConnection()
+	conn.channel.confirmByHand = true
+	client.dial = func(url string) (connection, error) {
+		return conn, nil
+	}
+
+	stop := runClient(t, client)
+	defer stop()
+	waitForState(t, client, broker.StateConnected)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- client.Publish("stock_quotes", broker.Message{Body: []byte(`{}`)})
+	}()
+	for conn.channel.publishes() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	conn.channel.close(&amqp.Error{Code: amqp.ChannelError, Reason: "channel error"})
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrNotConfirmed) {
+			t.Errorf("expected ErrNotConfirmed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the publish to return once the channel closed")
+	}
+}
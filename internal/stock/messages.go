@@ -0,0 +1,165 @@
+package stock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+)
+
+// ErrInvalidRequest is returned for requests the bot cannot answer
+var ErrInvalidRequest = errors.New("invalid stock request")
+
+// Request asks the bot for the quote of a stock on behalf of a chat user
+type Request struct {
+	CorrelationID string `json:"correlation_id"`
+	Username      string `json:"username"` // user who asked
+	Room          string `json:"room"`     // room the user asked in
+	StockCode     string `json:"stock_code"`
+	Private       bool   `json:"private"`  // reply only to the user who asked
+	ReplyTo       string `json:"reply_to"` // queue the reply is published to
+}
+
+// NewRequest creates a request with a fresh correlation ID, answered on QuoteQueue
+func NewRequest(username, room, stockCode string) Request {
+	return Request{
+		CorrelationID: newCorrelationID(),
+		Username:      username,
+		Room:          room,
+		StockCode:     stockCode,
+		ReplyTo:       QuoteQueue.Name,
+	}
+}
+
+// Validate checks that the request can be answered
+func (r Request) Validate() error {
+	if r.StockCode == "" {
+		return fmt.Errorf("%w: missing stock code", ErrInvalidRequest)
+	}
+	return nil
+}
+
+// Message encodes the request as a JSON message
+func (r Request) Message() (broker.Message, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return broker.Message{}, err
+	}
+
+	return broker.Message{
+		ContentType:   "application/json",
+		CorrelationID: r.CorrelationID,
+		ReplyTo:       r.ReplyQueue(),
+		Body:          body,
+	}, nil
+}
+
+// DecodeRequest decodes a request published by the chat server. Requests that
+// can never be answered are reported as broker.ErrPoison.
+func DecodeRequest(d broker.Delivery) (Request, error) {
+	var request Request
+	if err := json.Unmarshal(d.Body, &request); err != nil {
+		return Request{}, fmt.Errorf("%w: invalid stock request: %v", broker.ErrPoison, err)
+	}
+	if err := request.Validate(); err != nil {
+		return Request{}, fmt.Errorf("%w: %v", broker.ErrPoison, err)
+	}
+	if request.CorrelationID == "" {
+		request.CorrelationID = d.CorrelationID
+	}
+	if request.ReplyTo == "" {
+		request.ReplyTo = d.ReplyTo
+	}
+
+	return request, nil
+}
+
+// Reply answers the request with content, it goes back to the room and user that asked
+func (r Request) Reply(content string) Reply {
+	return Reply{
+		CorrelationID: r.CorrelationID,
+		Username:      r.Username,
+		Room:          r.Room,
+		StockCode:     r.StockCode,
+		Private:       r.Private,
+		Content:       content,
+	}
+}
+
+// Fail answers the request with the reason there is no quote for it, content
+// telling the user about it
+func (r Request) Fail(code ErrorCode, content string) Reply {
+	reply := r.Reply(content)
+	reply.Error = code
+	return reply
+}
+
+// ReplyQueue returns the queue the reply to the request is published to
+func (r Request) ReplyQueue() string {
+	if r.ReplyTo != "" {
+		return r.ReplyTo
+	}
+	return QuoteQueue.Name
+}
+
+// ErrorCode tells why a Reply carries no quote
+type ErrorCode string
+
+const (
+	ErrorUnknownSymbol   ErrorCode = "unknown_symbol"   // no stock has the code
+	ErrorUnreadableQuote ErrorCode = "unreadable_quote" // the quote source answered nonsense
+	ErrorTimeout         ErrorCode = "timeout"          // the quote source took too long
+	ErrorRateLimited     ErrorCode = "rate_limited"     // the quote source refused more requests
+	ErrorUnavailable     ErrorCode = "unavailable"      // the quote source failed otherwise
+)
+
+// Reply is the bot's answer to a Request
+type Reply struct {
+	CorrelationID string    `json:"correlation_id"`
+	Username      string    `json:"username"`
+	Room          string    `json:"room"`
+	StockCode     string    `json:"stock_code"`
+	Private       bool      `json:"private"`
+	Content       string    `json:"content"`
+	Error         ErrorCode `json:"error,omitempty"` // empty for quotes
+}
+
+// Message encodes the reply as a JSON message
+func (r Reply) Message() (broker.Message, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return broker.Message{}, err
+	}
+
+	return broker.Message{
+		ContentType:   "application/json",
+		CorrelationID: r.CorrelationID,
+		Body:          body,
+	}, nil
+}
+
+// DecodeReply decodes a reply published by the bot. Replies that can never be
+// decoded are reported as broker.ErrPoison.
+func DecodeReply(d broker.Delivery) (Reply, error) {
+	var reply Reply
+	if err := json.Unmarshal(d.Body, &reply); err != nil {
+		return Reply{}, fmt.Errorf("%w: invalid stock reply: %v", broker.ErrPoison, err)
+	}
+	if reply.Content == "" {
+		return Reply{}, fmt.Errorf("%w: stock reply without content", broker.ErrPoison)
+	}
+	if reply.CorrelationID == "" {
+		reply.CorrelationID = d.CorrelationID
+	}
+
+	return reply, nil
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,113 @@
+package stock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/andrerussowsky/chat-app/internal/broker"
+)
+
+func TestRequest_Reply(t *testing.T) {
+	request := NewRequest("testuser", "project-x", "AAPL.US")
+	if request.CorrelationID == "" || request.CorrelationID == NewRequest("testuser", "project-x", "AAPL.US").CorrelationID {
+		t.Errorf("expected a unique correlation ID, got %q", request.CorrelationID)
+	}
+	if request.ReplyQueue() != QuoteQueue.Name {
+		t.Errorf("unexpected reply queue: got %q want %q", request.ReplyQueue(), QuoteQueue.Name)
+	}
+
+	msg, err := request.Reply("AAPL.US quote is $93.42 per share").Message()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.CorrelationID != request.CorrelationID || msg.ContentType != "application/json" {
+		t.Errorf("unexpected publishing: %+v", msg)
+	}
+
+	reply, err := DecodeReply(broker.Delivery{Message: broker.Message{Body: msg.Body}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Reply{
+		CorrelationID: request.CorrelationID,
+		Username:      "testuser",
+		Room:          "project-x",
+		StockCode:     "AAPL.US",
+		Content:       "AAPL.US quote is $93.42 per share",
+	}
+	if reply != expected {
+		t.Errorf("unexpected reply: got %+v want %+v", reply, expected)
+	}
+}
+
+func TestRequest_Fail(t *testing.T) {
+	request := NewRequest("testuser", "project-x", "XYZ.US")
+	request.Private = true
+
+	msg, err := request.Fail(ErrorUnknownSymbol, "Sorry, I could not find a stock called XYZ.US.").Message()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reply, err := DecodeReply(broker.Delivery{Message: broker.Message{Body: msg.Body}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Reply{
+		CorrelationID: request.CorrelationID,
+		Username:      "testuser",
+		Room:          "project-x",
+		StockCode:     "XYZ.US",
+		Private:       true,
+		Content:       "Sorry, I could not find a stock called XYZ.US.",
+		Error:         ErrorUnknownSymbol,
+	}
+	if reply != expected {
+		t.Errorf("unexpected reply: got %+v want %+v", reply, expected)
+	}
+}
+
+func TestDecodeReply(t *testing.T) {
+	// The correlation ID property stands in for a missing body field
+	reply, err := DecodeReply(broker.Delivery{Message: broker.Message{CorrelationID: "abc", Body: []byte(`{"room":"general","content":"hi"}`)}})
+	if err != nil || reply.CorrelationID != "abc" {
+		t.Errorf("unexpected reply: %+v, %v", reply, err)
+	}
+
+	for _, body := range []string{"", "AAPL.US quote is $93.42 per share", `{"room":"general"}`} {
+		if _, err := DecodeReply(broker.Delivery{Message: broker.Message{Body: []byte(body)}}); !errors.Is(err, broker.ErrPoison) {
+			t.Errorf("expected ErrPoison for %q, got %v", body, err)
+		}
+	}
+}
+
+func TestRequest_Validate(t *testing.T) {
+	if err := NewRequest("testuser", "general", "").Validate(); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("expected ErrInvalidRequest, got %v", err)
+	}
+	if err := NewRequest("testuser", "general", "AAPL.US").Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	request := NewRequest("testuser", "project-x", "AAPL.US")
+	msg, err := request.Message()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.ReplyTo != QuoteQueue.Name || msg.CorrelationID != request.CorrelationID {
+		t.Errorf("unexpected publishing: %+v", msg)
+	}
+
+	decoded, err := DecodeRequest(broker.Delivery{Message: broker.Message{Body: msg.Body}})
+	if err != nil || decoded != request {
+		t.Errorf("unexpected request: got %+v, %v want %+v", decoded, err, request)
+	}
+
+	for _, body := range []string{"", "AAPL.US", `{"room":"general"}`} {
+		if _, err := DecodeRequest(broker.Delivery{Message: broker.Message{Body: []byte(body)}}); !errors.Is(err, broker.ErrPoison) {
+			t.Errorf("expected ErrPoison for %q, got %v", body, err)
+		}
+	}
+}
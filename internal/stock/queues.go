@@ -0,0 +1,20 @@
+// Package stock holds what the chat server and the stock bot share to talk over the message broker.
+package stock
+
+import "github.com/andrerussowsky/chat-app/internal/broker"
+
+// RequestQueue carries the stock requests of the chat server to the bots, every
+// request is handled by one of the running bots
+var RequestQueue = broker.Queue{
+	Name:       "stock_requests",
+	Durable:    true,
+	DeadLetter: "stock_requests.dead",
+}
+
+// QuoteQueue carries the quotes published by the bot to the chat server. Both
+// sides must declare it with the same settings.
+var QuoteQueue = broker.Queue{
+	Name:       "stock_quotes",
+	Durable:    true,
+	DeadLetter: "stock_quotes.dead",
+}
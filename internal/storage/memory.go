@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+)
+
+// MemoryUserStore is an in-memory UserStore, mainly used in tests
+type MemoryUserStore struct {
+	mu     sync.RWMutex
+	users  map[string]models.User
+	nextID int64
+}
+
+// NewMemoryUserStore creates an empty MemoryUserStore
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[string]models.User)}
+}
+
+func (s *MemoryUserStore) CreateUser(username, passwordHash string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[username]; exists {
+		return nil, ErrUserExists
+	}
+
+	s.nextID++
+	user := models.User{
+		ID:           s.nextID,
+		Username:     username,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now().UTC(),
+	}
+	s.users[username] = user
+
+	return &user, nil
+}
+
+func (s *MemoryUserStore) GetUser(username string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	return &user, nil
+}
+
+func (s *MemoryUserStore) UpdatePassword(username, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.PasswordHash = passwordHash
+	s.users[username] = user
+
+	return nil
+}
+
+func (s *MemoryUserStore) DisableUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.Disabled = true
+	s.users[username] = user
+
+	return nil
+}
+
+// MemoryMessageStore is an in-memory MessageStore, mainly used in tests
+type MemoryMessageStore struct {
+	mu       sync.RWMutex
+	messages []models.Message // ordered by ID
+}
+
+// NewMemoryMessageStore creates an empty MemoryMessageStore
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{}
+}
+
+func (s *MemoryMessageStore) AppendMessage(message models.Message) (models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message.ID = int64(len(s.messages) + 1)
+	s.messages = append(s.messages, message)
+
+	return message, nil
+}
+
+func (s *MemoryMessageStore) MessagesBefore(room string, before int64, limit int) ([]models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := []models.Message{}
+	for i := len(s.messages) - 1; i >= 0 && len(page) < limit; i-- {
+		message := s.messages[i]
+		if message.Room == room && (before == 0 || message.ID < before) {
+			page = append(page, message)
+		}
+	}
+	reverse(page)
+
+	return page, nil
+}
+
+func (s *MemoryMessageStore) MessagesAfter(room string, after int64, limit int) ([]models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := []models.Message{}
+	for i := 0; i < len(s.messages) && len(page) < limit; i++ {
+		message := s.messages[i]
+		if message.Room == room && message.ID > after {
+			page = append(page, message)
+		}
+	}
+
+	return page, nil
+}
+
+func (s *MemoryMessageStore) GetMessage(id int64) (*models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if id < 1 || id > int64(len(s.messages)) {
+		return nil, ErrMessageNotFound
+	}
+	message := s.messages[id-1]
+
+	return &message, nil
+}
+
+func (s *MemoryMessageStore) Rooms() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	rooms := []string{}
+	for _, message := range s.messages {
+		if !seen[message.Room] {
+			seen[message.Room] = true
+			rooms = append(rooms, message.Room)
+		}
+	}
+	sort.Strings(rooms)
+
+	return rooms, nil
+}
+
+// MemoryRevocationStore is an in-memory RevocationStore
+type MemoryRevocationStore struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time // token ID -> expiry
+}
+
+// NewMemoryRevocationStore creates an empty MemoryRevocationStore
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{revoked: make(map[string]time.Time)}
+}
+
+func (s *MemoryRevocationStore) Revoke(tokenID string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revoked[tokenID] = expiresAt
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, revoked := s.revoked[tokenID]
+	return revoked, nil
+}
+
+func (s *MemoryRevocationStore) PruneExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenID, expiresAt := range s.revoked {
+		if expiresAt.Before(now) {
+			delete(s.revoked, tokenID)
+		}
+	}
+	return nil
+}
+
+// reverse reverses messages in place
+func reverse(messages []models.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
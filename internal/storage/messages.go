@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+)
+
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageStore persists the chat history of every room
+type MessageStore interface {
+	// AppendMessage stores a message and returns it with its assigned ID
+	AppendMessage(message models.Message) (models.Message, error)
+	// MessagesBefore returns up to limit messages of a room with an ID lower than before,
+	// oldest first. A before of 0 returns the most recent messages.
+	MessagesBefore(room string, before int64, limit int) ([]models.Message, error)
+	// MessagesAfter returns up to limit messages of a room with an ID greater than after, oldest first
+	MessagesAfter(room string, after int64, limit int) ([]models.Message, error)
+	// GetMessage looks up a message by ID, failing with ErrMessageNotFound if it does not exist
+	GetMessage(id int64) (*models.Message, error)
+	// Rooms returns the names of the rooms that have any stored message
+	Rooms() ([]string, error)
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+)
+
+func newSQLiteMessageStore(t *testing.T) MessageStore {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewSQLiteMessageStore(db)
+}
+
+func TestMessageStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) MessageStore{
+		"memory": func(t *testing.T) MessageStore { return NewMemoryMessageStore() },
+		"sqlite": newSQLiteMessageStore,
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			messages := newStore(t)
+
+			var ids []int64
+			for i := 0; i < 5; i++ {
+				stored, err := messages.AppendMessage(models.Message{
+					Username: "alice",
+					Room:     "general",
+					Content:  fmt.Sprintf("message %d", i),
+				})
+				if err != nil {
+					t.Fatalf("unexpected error appending message: %v", err)
+				}
+				ids = append(ids, stored.ID)
+			}
+			messages.AppendMessage(models.Message{Username: "bob", Nickname: "Bobby", Room: "project-x", Content: "other room"})
+
+			latest, err := messages.MessagesBefore("general", 0, 2)
+			if err != nil {
+				t.Fatalf("unexpected error paging messages: %v", err)
+			}
+			if len(latest) != 2 || latest[0].Content != "message 3" || latest[1].Content != "message 4" {
+				t.Errorf("unexpected latest page: %+v", latest)
+			}
+
+			older, err := messages.MessagesBefore("general", latest[0].ID, 10)
+			if err != nil {
+				t.Fatalf("unexpected error paging messages: %v", err)
+			}
+			if len(older) != 3 || older[0].Content != "message 0" || older[2].Content != "message 2" {
+				t.Errorf("unexpected older page: %+v", older)
+			}
+
+			newer, err := messages.MessagesAfter("general", ids[1], 2)
+			if err != nil {
+				t.Fatalf("unexpected error paging messages: %v", err)
+			}
+			if len(newer) != 2 || newer[0].Content != "message 2" || newer[1].Content != "message 3" {
+				t.Errorf("unexpected newer page: %+v", newer)
+			}
+
+			message, err := messages.GetMessage(ids[1])
+			if err != nil {
+				t.Fatalf("unexpected error getting message: %v", err)
+			}
+			if message.Content != "message 1" || message.Room != "general" || message.Username != "alice" {
+				t.Errorf("unexpected message: %+v", message)
+			}
+			if _, err := messages.GetMessage(1000); !errors.Is(err, ErrMessageNotFound) {
+				t.Errorf("expected ErrMessageNotFound, got %v", err)
+			}
+
+			if other, _ := messages.MessagesBefore("project-x", 0, 1); len(other) != 1 || other[0].Nickname != "Bobby" {
+				t.Errorf("unexpected nickname: %+v", other)
+			}
+
+			rooms, err := messages.Rooms()
+			if err != nil {
+				t.Fatalf("unexpected error listing rooms: %v", err)
+			}
+			if len(rooms) != 2 || rooms[0] != "general" || rooms[1] != "project-x" {
+				t.Errorf("unexpected rooms: %v", rooms)
+			}
+		})
+	}
+}
+
+func TestOpenSQLite_AddsColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+
+	// A database created before the nickname column existed
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE messages (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		room      TEXT NOT NULL,
+		username  TEXT NOT NULL,
+		content   TEXT NOT NULL,
+		timestamp TEXT NOT NULL
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("INSERT INTO messages (room, username, content, timestamp) VALUES ('general', 'alice', 'old', '')")
+	db.Close()
+
+	// Opening it twice adds the column once
+	for i := 0; i < 2; i++ {
+		db, err = OpenSQLite(path)
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		page, err := NewSQLiteMessageStore(db).MessagesBefore("general", 0, 10)
+		if err != nil || len(page) != 1 || page[0].Content != "old" || page[0].Nickname != "" {
+			t.Errorf("unexpected messages: %+v, %v", page, err)
+		}
+		db.Close()
+	}
+}
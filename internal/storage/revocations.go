@@ -0,0 +1,13 @@
+package storage
+
+import "time"
+
+// RevocationStore keeps the IDs (jti claim) of tokens revoked before their expiry
+type RevocationStore interface {
+	// Revoke marks a token as revoked, it only needs to be remembered until expiresAt
+	Revoke(tokenID string, expiresAt time.Time) error
+	// IsRevoked reports whether a token was revoked
+	IsRevoked(tokenID string) (bool, error)
+	// PruneExpired forgets the revoked tokens that expired before now
+	PruneExpired(now time.Time) error
+}
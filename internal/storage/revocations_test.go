@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newSQLiteRevocationStore(t *testing.T) RevocationStore {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewSQLiteRevocationStore(db)
+}
+
+func TestRevocationStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) RevocationStore{
+		"memory": func(t *testing.T) RevocationStore { return NewMemoryRevocationStore() },
+		"sqlite": newSQLiteRevocationStore,
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			revocations := newStore(t)
+			now := time.Now()
+
+			if err := revocations.Revoke("expired", now.Add(-time.Minute)); err != nil {
+				t.Fatalf("unexpected error revoking token: %v", err)
+			}
+			if err := revocations.Revoke("current", now.Add(time.Hour)); err != nil {
+				t.Fatalf("unexpected error revoking token: %v", err)
+			}
+			if err := revocations.Revoke("current", now.Add(time.Hour)); err != nil {
+				t.Fatalf("revoking twice should not fail: %v", err)
+			}
+
+			for tokenID, expected := range map[string]bool{"expired": true, "current": true, "other": false} {
+				if revoked, err := revocations.IsRevoked(tokenID); err != nil || revoked != expected {
+					t.Errorf("unexpected revocation of %s: got %v, %v want %v", tokenID, revoked, err, expected)
+				}
+			}
+
+			if err := revocations.PruneExpired(now); err != nil {
+				t.Fatalf("unexpected error pruning: %v", err)
+			}
+			if revoked, _ := revocations.IsRevoked("expired"); revoked {
+				t.Error("expected expired token to be pruned")
+			}
+			if revoked, _ := revocations.IsRevoked("current"); !revoked {
+				t.Error("expected current token to stay revoked")
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+)
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		username      TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		disabled      INTEGER NOT NULL DEFAULT 0,
+		created_at    TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		room      TEXT NOT NULL,
+		username  TEXT NOT NULL,
+		content   TEXT NOT NULL,
+		timestamp TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS messages_room_id ON messages (room, id)`,
+	`CREATE TABLE IF NOT EXISTS revoked_tokens (
+		token_id   TEXT PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS revoked_tokens_expires_at ON revoked_tokens (expires_at)`,
+}
+
+// column is a column added to a table after it was first created
+type column struct {
+	table, name, definition string
+}
+
+var addedColumns = []column{
+	{"messages", "nickname", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// OpenSQLite opens the SQLite database at path and creates any missing tables
+func OpenSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	for _, c := range addedColumns {
+		if err := addColumn(db, c); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// addColumn adds c to its table unless the table already has it
+func addColumn(db *sql.DB, c column) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", c.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == c.name {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE " + c.table + " ADD COLUMN " + c.name + " " + c.definition)
+	return err
+}
+
+// SQLiteUserStore is a UserStore backed by a SQLite database
+type SQLiteUserStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteUserStore creates a SQLiteUserStore on a database opened with OpenSQLite
+func NewSQLiteUserStore(db *sql.DB) *SQLiteUserStore {
+	return &SQLiteUserStore{db: db}
+}
+
+func (s *SQLiteUserStore) CreateUser(username, passwordHash string) (*models.User, error) {
+	createdAt := time.Now().UTC()
+
+	res, err := s.db.Exec(
+		"INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)",
+		username, passwordHash, createdAt,
+	)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return nil, ErrUserExists
+		}
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.User{
+		ID:           id,
+		Username:     username,
+		PasswordHash: passwordHash,
+		CreatedAt:    createdAt,
+	}, nil
+}
+
+func (s *SQLiteUserStore) GetUser(username string) (*models.User, error) {
+	var user models.User
+	err := s.db.QueryRow(
+		"SELECT id, username, password_hash, disabled, created_at FROM users WHERE username = ?",
+		username,
+	).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Disabled, &user.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *SQLiteUserStore) UpdatePassword(username, passwordHash string) error {
+	res, err := s.db.Exec("UPDATE users SET password_hash = ? WHERE username = ?", passwordHash, username)
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(res, ErrUserNotFound)
+}
+
+func (s *SQLiteUserStore) DisableUser(username string) error {
+	res, err := s.db.Exec("UPDATE users SET disabled = 1 WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(res, ErrUserNotFound)
+}
+
+// SQLiteMessageStore is a MessageStore backed by a SQLite database
+type SQLiteMessageStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteMessageStore creates a SQLiteMessageStore on a database opened with OpenSQLite
+func NewSQLiteMessageStore(db *sql.DB) *SQLiteMessageStore {
+	return &SQLiteMessageStore{db: db}
+}
+
+func (s *SQLiteMessageStore) AppendMessage(message models.Message) (models.Message, error) {
+	res, err := s.db.Exec(
+		"INSERT INTO messages (room, username, nickname, content, timestamp) VALUES (?, ?, ?, ?, ?)",
+		message.Room, message.Username, message.Nickname, message.Content, message.Timestamp,
+	)
+	if err != nil {
+		return message, err
+	}
+
+	message.ID, err = res.LastInsertId()
+	if err != nil {
+		return message, err
+	}
+
+	return message, nil
+}
+
+func (s *SQLiteMessageStore) MessagesBefore(room string, before int64, limit int) ([]models.Message, error) {
+	query := "SELECT id, room, username, nickname, content, timestamp FROM messages WHERE room = ? ORDER BY id DESC LIMIT ?"
+	args := []interface{}{room, limit}
+	if before > 0 {
+		query = "SELECT id, room, username, nickname, content, timestamp FROM messages WHERE room = ? AND id < ? ORDER BY id DESC LIMIT ?"
+		args = []interface{}{room, before, limit}
+	}
+
+	page, err := s.queryMessages(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	reverse(page)
+
+	return page, nil
+}
+
+func (s *SQLiteMessageStore) MessagesAfter(room string, after int64, limit int) ([]models.Message, error) {
+	return s.queryMessages(
+		"SELECT id, room, username, nickname, content, timestamp FROM messages WHERE room = ? AND id > ? ORDER BY id ASC LIMIT ?",
+		room, after, limit,
+	)
+}
+
+func (s *SQLiteMessageStore) GetMessage(id int64) (*models.Message, error) {
+	var message models.Message
+	err := s.db.QueryRow(
+		"SELECT id, room, username, nickname, content, timestamp FROM messages WHERE id = ?",
+		id,
+	).Scan(&message.ID, &message.Room, &message.Username, &message.Nickname, &message.Content, &message.Timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+func (s *SQLiteMessageStore) Rooms() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT room FROM messages ORDER BY room")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []string{}
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+
+	return rooms, rows.Err()
+}
+
+func (s *SQLiteMessageStore) queryMessages(query string, args ...interface{}) ([]models.Message, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []models.Message{}
+	for rows.Next() {
+		var message models.Message
+		if err := rows.Scan(&message.ID, &message.Room, &message.Username, &message.Nickname, &message.Content, &message.Timestamp); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+// SQLiteRevocationStore is a RevocationStore backed by a SQLite database
+type SQLiteRevocationStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteRevocationStore creates a SQLiteRevocationStore on a database opened with OpenSQLite
+func NewSQLiteRevocationStore(db *sql.DB) *SQLiteRevocationStore {
+	return &SQLiteRevocationStore{db: db}
+}
+
+func (s *SQLiteRevocationStore) Revoke(tokenID string, expiresAt time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO revoked_tokens (token_id, expires_at) VALUES (?, ?) ON CONFLICT (token_id) DO NOTHING",
+		tokenID, expiresAt.UTC(),
+	)
+	return err
+}
+
+func (s *SQLiteRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE token_id = ?)", tokenID).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *SQLiteRevocationStore) PruneExpired(now time.Time) error {
+	_, err := s.db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now.UTC())
+	return err
+}
+
+// checkAffected returns notFound when res did not touch any row
+func checkAffected(res sql.Result, notFound error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+
+	return nil
+}
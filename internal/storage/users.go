@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/andrerussowsky/chat-app/internal/models"
+)
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// UserStore persists user accounts on the server
+type UserStore interface {
+	// CreateUser stores a new account, failing with ErrUserExists if the username is taken
+	CreateUser(username, passwordHash string) (*models.User, error)
+	// GetUser looks up an account by username, failing with ErrUserNotFound if it does not exist
+	GetUser(username string) (*models.User, error)
+	// UpdatePassword replaces the stored password hash of an account
+	UpdatePassword(username, passwordHash string) error
+	// DisableUser marks an account as disabled so it can no longer log in
+	DisableUser(username string) error
+}
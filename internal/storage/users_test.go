@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newSQLiteUserStore(t *testing.T) UserStore {
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewSQLiteUserStore(db)
+}
+
+func TestUserStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) UserStore{
+		"memory": func(t *testing.T) UserStore { return NewMemoryUserStore() },
+		"sqlite": newSQLiteUserStore,
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			users := newStore(t)
+
+			created, err := users.CreateUser("alice", "hash1")
+			if err != nil {
+				t.Fatalf("unexpected error creating user: %v", err)
+			}
+			if created.ID == 0 || created.Username != "alice" {
+				t.Errorf("unexpected created user: %+v", created)
+			}
+
+			if _, err := users.CreateUser("alice", "hash2"); !errors.Is(err, ErrUserExists) {
+				t.Errorf("expected ErrUserExists, got %v", err)
+			}
+
+			if err := users.UpdatePassword("alice", "hash3"); err != nil {
+				t.Fatalf("unexpected error updating password: %v", err)
+			}
+			if err := users.DisableUser("alice"); err != nil {
+				t.Fatalf("unexpected error disabling user: %v", err)
+			}
+
+			user, err := users.GetUser("alice")
+			if err != nil {
+				t.Fatalf("unexpected error getting user: %v", err)
+			}
+			if user.PasswordHash != "hash3" {
+				t.Errorf("unexpected password hash: got %v, want %v", user.PasswordHash, "hash3")
+			}
+			if !user.Disabled {
+				t.Error("expected user to be disabled")
+			}
+
+			if _, err := users.GetUser("bob"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected ErrUserNotFound, got %v", err)
+			}
+			if err := users.UpdatePassword("bob", "hash"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected ErrUserNotFound, got %v", err)
+			}
+			if err := users.DisableUser("bob"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected ErrUserNotFound, got %v", err)
+			}
+		})
+	}
+}